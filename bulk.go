@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// bulkFlushInterval is the longest a queued operation waits for its batch to fill up before the batch is sent
+const bulkFlushInterval = 250 * time.Millisecond
+
+// bulkOperation is a single write queued by a person in flight for a batched request, along with where to deliver
+// its result
+type bulkOperation struct {
+	method string
+	path   string
+	data   string
+	bulkID string
+	pool   *workerPool // pool of the worker that queued it
+	result chan bulkResult
+}
+
+// bulkResult is the outcome of a single operation within a batched request
+type bulkResult struct {
+	status    int
+	response  gjson.Result
+	location  string // URI of the resource a POST created
+	batchSize int
+	err       error
+}
+
+// batchQueue collects the operations queued by every person in flight into batches and hands each batch to a send
+// function once it is full, everyone in flight is waiting on a batched write or the flush interval has passed.
+// Each person waits for the result of their own operation, without holding a worker, so results are reported
+// against the person who queued them.  A batchQueue is safe to use from many goroutines.
+type batchQueue struct {
+	size   int
+	queue  chan *bulkOperation
+	send   func(batch []*bulkOperation)
+	nextID int64
+}
+
+//
+// Returns a batchQueue that sends batches of up to size operations and starts its batching goroutine
+//
+func newBatchQueue(size int, send func(batch []*bulkOperation)) *batchQueue {
+	queue := &batchQueue{size: size, queue: make(chan *bulkOperation), send: send}
+	go queue.run()
+	return queue
+}
+
+//
+// Queue an operation and wait for its result.  The person's worker is given up while waiting so that other people
+// can queue their writes into the same batch.  The returned error is only set when the operation's result couldn't
+// be determined; failures of the operation itself are reported through the result's status.
+//
+func (queue *batchQueue) submit(ctx context.Context, method string, path string, data string) (bulkResult, error) {
+	pool := workerPoolFrom(ctx)
+	op := &bulkOperation{method: method, path: path, data: data, pool: pool,
+		bulkID: "op" + strconv.FormatInt(atomic.AddInt64(&queue.nextID, 1), 10), result: make(chan bulkResult, 1)}
+
+	select {
+	case queue.queue <- op:
+	case <-ctx.Done():
+		return bulkResult{}, ctx.Err()
+	}
+
+	// once queued the operation may be sent at any time so always wait for its result
+	pool.park()
+	result := <-op.result
+	pool.unpark()
+	return result, result.err
+}
+
+//
+// Deliver the operation's result to the person waiting on it, who counts as running again from now on so that a
+// batch being collected isn't sent before they can join it
+//
+func (op *bulkOperation) deliver(result bulkResult) {
+	op.pool.wake()
+	op.result <- result
+}
+
+//
+// Collect queued operations into batches and send each batch once it is full, everyone in flight is waiting on a
+// batched write or the flush interval has passed.  Sending as soon as nobody else can join keeps a single person
+// from waiting out the flush interval on every write.
+//
+func (queue *batchQueue) run() {
+	for op := range queue.queue {
+		batch := []*bulkOperation{op}
+		timer := time.NewTimer(bulkFlushInterval)
+	collect:
+		for len(batch) < queue.size {
+			select {
+			case op := <-queue.queue:
+				batch = append(batch, op)
+			case <-batch[0].pool.waiting():
+				break collect
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		queue.send(batch)
+	}
+}
+
+// BulkWriter collects IDCS user creates and group membership changes from every person in flight into /admin/v1/Bulk
+// requests
+type BulkWriter struct {
+	config       Config
+	client       *HTTPClient
+	authorize    func(req *http.Request) error
+	failOnErrors int
+	queue        *batchQueue
+}
+
+//
+// Returns a BulkWriter that sends batches of up to IdcsBulkBatchSize operations
+//
+func NewBulkWriter(config Config, client *HTTPClient, authorize func(req *http.Request) error) *BulkWriter {
+	writer := &BulkWriter{config: config, client: client, authorize: authorize, failOnErrors: config.IdcsBulkFailOnErrors}
+	writer.queue = newBatchQueue(config.IdcsBulkBatchSize, writer.send)
+	return writer
+}
+
+//
+// Queue an operation and wait for its result.  path is relative to /admin/v1 (e.g. /Users or /Groups/{id}).  HTTP
+// level failures of the operation itself are reported through the result's status.
+//
+func (writer *BulkWriter) Submit(ctx context.Context, method string, path string, data string) (bulkResult, error) {
+	result, err := writer.queue.submit(ctx, method, path, data)
+	if err != nil {
+		return result, err
+	}
+	logFrom(ctx).Infof("** IDCS bulk %s %s -> %d (batch of %d)", method, path, result.status, result.batchSize)
+	return result, nil
+}
+
+//
+// Send a batch as a single SCIM Bulk request and deliver each operation's result to the person waiting on it.
+// Operations that IDCS didn't get to because failOnErrors was reached are reported as failed.
+//
+func (writer *BulkWriter) send(batch []*bulkOperation) {
+	type operation struct {
+		Method string          `json:"method"`
+		Path   string          `json:"path"`
+		BulkID string          `json:"bulkId"`
+		Data   json.RawMessage `json:"data,omitempty"`
+	}
+	request := struct {
+		Schemas      []string    `json:"schemas"`
+		FailOnErrors int         `json:"failOnErrors,omitempty"`
+		Operations   []operation `json:"Operations"`
+	}{Schemas: []string{"urn:ietf:params:scim:api:messages:2.0:BulkRequest"}, FailOnErrors: writer.failOnErrors}
+	for _, op := range batch {
+		request.Operations = append(request.Operations, operation{Method: op.method, Path: op.path, BulkID: op.bulkID,
+			Data: json.RawMessage(op.data)})
+	}
+
+	results, err := writer.post(request)
+	for _, op := range batch {
+		result, ok := results[op.bulkID]
+		if err != nil {
+			result = bulkResult{err: err}
+		} else if !ok {
+			result = bulkResult{err: fmt.Errorf("ERROR: IDCS bulk %s %s was not processed, the bulk request stopped after %d errors",
+				op.method, op.path, writer.failOnErrors)}
+		}
+		result.batchSize = len(batch)
+		op.deliver(result)
+	}
+}
+
+//
+// POST a bulk request and return the result of each operation keyed by bulkId
+//
+func (writer *BulkWriter) post(request interface{}) (map[string]bulkResult, error) {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, _ := http.NewRequest("POST", writer.config.IdcsBaseURL+"/admin/v1/Bulk", strings.NewReader(string(payload)))
+	if err := writer.authorize(req); err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Length", strconv.Itoa(len(payload)))
+	res, err := writer.client.Do(req)
+	if err != nil || res == nil || res.StatusCode != 200 {
+		return nil, httpError("Sending IDCS bulk request", err, res)
+	}
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(res.Body)
+	results := make(map[string]bulkResult)
+	for _, op := range gjson.Get(string(body), "Operations").Array() {
+		results[op.Get("bulkId").String()] = bulkResult{status: int(op.Get("status").Int()), response: op.Get("response"),
+			location: op.Get("location").String()}
+	}
+	return results, nil
+}
+
+//
+// Describe a failed bulk operation the same way a failed direct call is described, carrying the operation's status
+//
+func (result bulkResult) failure(action string) error {
+	return &HTTPError{Status: result.status, Message: fmt.Sprintf("ERROR: %s: bulk operation returned %d: detail ->%s",
+		action, result.status, result.response.Raw)}
+}
+
+//
+// Returns the ID of the resource a POST created.  SCIM only requires a bulk response to carry the resource's
+// location so the ID is taken from its last path segment when there is no response body with an id.  Returns an
+// empty string when neither is present.
+//
+func (result bulkResult) createdID() string {
+	if id := result.response.Get("id").String(); len(id) > 0 {
+		return id
+	}
+	location := strings.TrimRight(result.location, "/")
+	return location[strings.LastIndex(location, "/")+1:]
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// quietContext carries a logger that drops everything below errors so worker output doesn't clutter test output
+func quietContext() context.Context {
+	return withLogger(context.Background(), &Logger{out: ioutil.Discard, settings: &logSettings{level: LevelError}})
+}
+
+// recordingSend returns a send function that answers every operation with a status taken from its data and
+// records the size of every batch it was given
+func recordingSend(sizes *[]int, mutex *sync.Mutex) func(batch []*bulkOperation) {
+	return func(batch []*bulkOperation) {
+		mutex.Lock()
+		*sizes = append(*sizes, len(batch))
+		mutex.Unlock()
+		for _, op := range batch {
+			status, _ := strconv.Atoi(op.data)
+			op.deliver(bulkResult{status: status, batchSize: len(batch)})
+		}
+	}
+}
+
+func TestBatchQueueFillsBatchesBeyondWorkers(t *testing.T) {
+	tests := []struct {
+		name    string
+		people  int
+		workers int
+		size    int
+		want    []int
+	}{
+		{"single worker", 30, 1, 10, []int{10, 10, 10}},
+		{"last batch short", 25, 2, 10, []int{10, 10, 5}},
+		{"batch smaller than workers", 8, 4, 2, []int{2, 2, 2, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sizes []int
+			var mutex sync.Mutex
+			queue := newBatchQueue(test.size, recordingSend(&sizes, &mutex))
+			people := make([]AriaServicePerson, test.people)
+			for i := range people {
+				people[i] = AriaServicePerson{UserID: strconv.Itoa(200 + i)}
+			}
+
+			var wrong []string
+			counters := runWorkers(quietContext(), make(chan struct{}), people, test.workers, test.size,
+				func(ctx context.Context, person AriaServicePerson) error {
+					result, err := queue.submit(ctx, "POST", "/Users", person.UserID)
+					if err != nil {
+						return err
+					}
+					if strconv.Itoa(result.status) != person.UserID {
+						mutex.Lock()
+						wrong = append(wrong, person.UserID)
+						mutex.Unlock()
+					}
+					return nil
+				})
+
+			if counters.Succeeded() != test.people {
+				t.Errorf("succeeded = %d, want %d", counters.Succeeded(), test.people)
+			}
+			if len(wrong) > 0 {
+				t.Errorf("people given another operation's result: %v", wrong)
+			}
+			if len(sizes) != len(test.want) {
+				t.Fatalf("batch sizes = %v, want %v", sizes, test.want)
+			}
+			for i := range sizes {
+				if sizes[i] != test.want[i] {
+					t.Fatalf("batch sizes = %v, want %v", sizes, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchQueueSendsAloneOutsideWorkers(t *testing.T) {
+	var sizes []int
+	var mutex sync.Mutex
+	queue := newBatchQueue(50, recordingSend(&sizes, &mutex))
+
+	started := time.Now()
+	result, err := queue.submit(context.Background(), "DELETE", "/Users/1", "204")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.status != 204 || result.batchSize != 1 {
+		t.Errorf("result = %d in a batch of %d, want 204 in a batch of 1", result.status, result.batchSize)
+	}
+	if waited := time.Since(started); waited >= bulkFlushInterval {
+		t.Errorf("waited %s for a batch nobody else could join", waited)
+	}
+}
+
+func TestBulkWriterCreatedID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Operations": [
+			{"bulkId": "op1", "status": "201", "location": "https://idcs/admin/v1/Users/abc", "response": {"id": "abc"}},
+			{"bulkId": "op2", "status": "201", "location": "https://idcs/admin/v1/Users/def"},
+			{"bulkId": "op3", "status": "201"}]}`))
+	}))
+	defer server.Close()
+
+	writer := &BulkWriter{config: Config{IdcsBaseURL: server.URL}, client: NewHTTPClient(Config{}, http.DefaultClient, "TEST"),
+		authorize: func(req *http.Request) error { return nil }}
+	results, err := writer.post(struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for bulkID, want := range map[string]string{"op1": "abc", "op2": "def", "op3": ""} {
+		if id := results[bulkID].createdID(); id != want {
+			t.Errorf("%s: createdID() = %q, want %q", bulkID, id, want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCheckpointFile is used when CheckpointFile isn't configured
+const defaultCheckpointFile = "sync-checkpoint.json"
+
+// checkpointFlushEvery is how many finished users may go unsaved before the checkpoint is written again
+const checkpointFlushEvery = 25
+
+// Checkpoint records the progress of an --add run so an interrupted run can be resumed with --resume.  It is
+// written to disk as users finish and removed once the run completes.  It is safe to use from many goroutines.
+type Checkpoint struct {
+	RunID         string            `json:"runId"`
+	Started       time.Time         `json:"started"`
+	Phases        []string          `json:"phases"`        // targets of each loop, a resume with other targets starts over
+	Phase         int               `json:"phase"`         // loop in progress, earlier loops are complete
+	LastCompleted int               `json:"lastCompleted"` // feed index up to which every user of the loop is done, -1 for none
+	Outcomes      map[string]string `json:"outcomes"`      // outcome of each finished user of the loop, keyed by lowercase email
+
+	filename string
+	state    *StateStore  // saved before every checkpoint write so the checkpoint is never ahead of the state file
+	work     []int        // feed indexes of the users the loop is processing this run, in order
+	done     map[int]bool // feed indexes finished this run
+	next     int          // position in work of the first user that isn't done
+	unsaved  int
+	mutex    sync.Mutex
+}
+
+//
+// Returns an identifier for a run, made of its start time and a random suffix
+//
+func newRunID() string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+}
+
+//
+// Returns the checkpoint for this run.  When resuming, the checkpoint left by the interrupted run is picked up if
+// it was made with the same loops, otherwise a new run is started with the given run ID.  phases names the targets
+// of each loop.  The state store is saved whenever the checkpoint is written.
+//
+func openCheckpoint(config Config, state *StateStore, resume bool, phases []string, runID string) (*Checkpoint, error) {
+	filename := config.CheckpointFile
+	if len(filename) < 1 {
+		filename = defaultCheckpointFile
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		previous := &Checkpoint{}
+		if err := json.Unmarshal(data, previous); err != nil {
+			return nil, err
+		}
+		if !resume {
+			rootLog.Warnf("*** Ignoring the checkpoint of interrupted run %s, run with --resume to continue it", previous.RunID)
+		} else if strings.Join(previous.Phases, ";") != strings.Join(phases, ";") {
+			rootLog.Warnf("*** Can't resume run %s, its targets were %s.  Starting a new run", previous.RunID,
+				strings.Join(previous.Phases, "; "))
+		} else {
+			previous.filename = filename
+			previous.state = state
+			if previous.Outcomes == nil {
+				previous.Outcomes = make(map[string]string)
+			}
+			rootLog.Infof("*** Resuming run %s", previous.RunID)
+			return previous, nil
+		}
+	} else if resume {
+		rootLog.Warnf("*** No checkpoint to resume from.  Starting a new run")
+	}
+
+	return &Checkpoint{RunID: runID, Started: time.Now(), Phases: phases, LastCompleted: -1,
+		Outcomes: make(map[string]string), filename: filename, state: state}, nil
+}
+
+//
+// Start processing a loop and return the people it still has to process.  Outcomes carry over when a resumed run
+// picks up the loop it was interrupted in, so people who already succeeded in it are left out; people who failed
+// are tried again.  feedIndex maps each lowercase email to the person's position in the feed.
+//
+func (cp *Checkpoint) beginPhase(phase int, people []AriaServicePerson, feedIndex map[string]int) []AriaServicePerson {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	if phase != cp.Phase {
+		cp.Phase = phase
+		cp.LastCompleted = -1
+		cp.Outcomes = make(map[string]string)
+	}
+
+	var remaining []AriaServicePerson
+	cp.work = nil
+	for _, person := range people {
+		email := strings.ToLower(strings.TrimSpace(person.UserID))
+		if cp.Outcomes[email] == "succeeded" {
+			continue
+		}
+		remaining = append(remaining, person)
+		cp.work = append(cp.work, feedIndex[email])
+	}
+	cp.done = make(map[int]bool)
+	cp.next = 0
+	return remaining
+}
+
+//
+// Mark a loop as complete and write the checkpoint straight away, so a run that is killed while the next loop's
+// targets are being prepared resumes with the next loop rather than repeating this one
+//
+func (cp *Checkpoint) completePhase(phase int) error {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	cp.Phase = phase + 1
+	cp.LastCompleted = -1
+	cp.Outcomes = make(map[string]string)
+	cp.work, cp.done, cp.next = nil, make(map[int]bool), 0
+	return cp.write()
+}
+
+//
+// Record a user's outcome and write the checkpoint once enough users have finished since it was last written
+//
+func (cp *Checkpoint) record(index int, email string, err error) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	outcome := "succeeded"
+	if err != nil {
+		outcome = "failed"
+	}
+	cp.Outcomes[strings.ToLower(strings.TrimSpace(email))] = outcome
+
+	cp.done[index] = true
+	for cp.next < len(cp.work) && cp.done[cp.work[cp.next]] {
+		cp.LastCompleted = cp.work[cp.next]
+		cp.next++
+	}
+
+	cp.unsaved++
+	if cp.unsaved >= checkpointFlushEvery {
+		if err := cp.write(); err != nil {
+			rootLog.Errorf("Error writing checkpoint file: %s", err.Error())
+		}
+	}
+}
+
+//
+// Write the state file and then the checkpoint to disk
+//
+func (cp *Checkpoint) Save() error {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	return cp.write()
+}
+
+//
+// Save the state file, then write the checkpoint to a temporary file and rename it over the checkpoint file.  The
+// state goes first so a process killed in between never leaves a checkpoint that marks users as done whose
+// ownership records and failures weren't saved.  The caller holds the mutex.
+//
+func (cp *Checkpoint) write() error {
+	if err := cp.state.Save(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(cp.filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+	cp.unsaved = 0
+	return os.Rename(cp.filename+".tmp", cp.filename)
+}
+
+//
+// Delete the checkpoint once the run has completed
+//
+func (cp *Checkpoint) Remove() error {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	if err := os.Remove(cp.filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
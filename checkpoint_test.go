@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{CheckpointFile: filepath.Join(dir, "checkpoint.json"), StateFile: filepath.Join(dir, "state.json")}
+	state, err := LoadStateStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phases := []string{"IDCS, ECAL", "OCE"}
+	people := []AriaServicePerson{{UserID: "a@oracle.com"}, {UserID: "b@oracle.com"}, {UserID: "c@oracle.com"},
+		{UserID: "d@oracle.com"}}
+	feedIndex := map[string]int{"a@oracle.com": 0, "b@oracle.com": 1, "c@oracle.com": 2, "d@oracle.com": 3}
+
+	// first run: a and c succeed, b fails and d is never reached
+	cp, err := openCheckpoint(config, state, false, phases, "run-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.beginPhase(0, people, feedIndex)
+	cp.record(0, "a@oracle.com", nil)
+	cp.record(2, "C@oracle.com", nil)
+	if cp.LastCompleted != 0 {
+		t.Errorf("LastCompleted = %d with b unfinished, want 0", cp.LastCompleted)
+	}
+	cp.record(1, "b@oracle.com", errors.New("failed"))
+	if cp.LastCompleted != 2 {
+		t.Errorf("LastCompleted = %d once a to c finished, want 2", cp.LastCompleted)
+	}
+	if err := cp.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(config.StateFile); err != nil {
+		t.Errorf("state file wasn't saved along with the checkpoint: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		resume    bool
+		phases    []string
+		wantRunID string
+		wantPhase int
+		wantUsers []string
+	}{
+		{"not resuming", false, phases, "run-2", 0, []string{"a@oracle.com", "b@oracle.com", "c@oracle.com", "d@oracle.com"}},
+		{"other targets", true, []string{"IDCS"}, "run-2", 0, []string{"a@oracle.com", "b@oracle.com", "c@oracle.com", "d@oracle.com"}},
+		{"resuming", true, phases, "run-1", 0, []string{"b@oracle.com", "d@oracle.com"}},
+	}
+	for _, test := range tests {
+		resumed, err := openCheckpoint(config, state, test.resume, test.phases, "run-2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resumed.RunID != test.wantRunID || resumed.Phase != test.wantPhase {
+			t.Errorf("%s: run %s in loop %d, want run %s in loop %d", test.name, resumed.RunID, resumed.Phase,
+				test.wantRunID, test.wantPhase)
+		}
+		remaining := resumed.beginPhase(0, people, feedIndex)
+		if len(remaining) != len(test.wantUsers) {
+			t.Errorf("%s: %d users remaining, want %v", test.name, len(remaining), test.wantUsers)
+			continue
+		}
+		for i, person := range remaining {
+			if person.UserID != test.wantUsers[i] {
+				t.Errorf("%s: remaining user %d is %s, want %s", test.name, i, person.UserID, test.wantUsers[i])
+			}
+		}
+	}
+}
+
+func TestCheckpointCompletePhase(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{CheckpointFile: filepath.Join(dir, "checkpoint.json"), StateFile: filepath.Join(dir, "state.json")}
+	state, err := LoadStateStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phases := []string{"IDCS", "OCE"}
+	people := []AriaServicePerson{{UserID: "a@oracle.com"}, {UserID: "b@oracle.com"}}
+	feedIndex := map[string]int{"a@oracle.com": 0, "b@oracle.com": 1}
+
+	cp, err := openCheckpoint(config, state, false, phases, "run-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.beginPhase(0, people, feedIndex)
+	cp.record(0, "a@oracle.com", nil)
+	cp.record(1, "b@oracle.com", nil)
+	if err := cp.completePhase(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// killed while OCE is being prepared: the resumed run goes straight to the OCE loop with nobody done in it
+	resumed, err := openCheckpoint(config, state, true, phases, "run-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.RunID != "run-1" || resumed.Phase != 1 {
+		t.Errorf("resumed run %s in loop %d, want run-1 in loop 1", resumed.RunID, resumed.Phase)
+	}
+	if remaining := resumed.beginPhase(1, people, feedIndex); len(remaining) != 2 {
+		t.Errorf("%d users remaining in the OCE loop, want 2", len(remaining))
+	}
+}
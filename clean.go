@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultCleanMaxRemovalPercent caps --clean --auto for each target when neither removal limit is configured
+const defaultCleanMaxRemovalPercent = 5.0
+
+// defaultDeprovisionGraceDays is how long a leaver stays deactivated before being deleted when DeprovisionGraceDays
+// isn't configured
+const defaultDeprovisionGraceDays = 30
+
+// CleanReport records the outcome of a --clean run and is written out as JSON once the run is done
+type CleanReport struct {
+	Generated time.Time            `json:"generated"`
+	Auto      bool                 `json:"auto"`
+	Aborted   bool                 `json:"aborted"`
+	Targets   []*TargetCleanReport `json:"targets"`
+}
+
+// TargetCleanReport records the stale users found in a single target and what happened to each of them
+type TargetCleanReport struct {
+	Target      string   `json:"target"`
+	Limit       int      `json:"limit"`
+	Aborted     bool     `json:"aborted"`
+	Reason      string   `json:"reason,omitempty"`
+	Stale       []string `json:"stale"`
+	Unmanaged   []string `json:"unmanaged"` // not in the feed but not provisioned by this tool, so left alone
+	Deactivated []string `json:"deactivated"`
+	Pending     []string `json:"pending"` // deactivated on an earlier run and still within the grace period
+	Removed     []string `json:"removed"`
+	Skipped     []string `json:"skipped"`
+	Failed      []string `json:"failed"`
+}
+
+//
+// Deprovisions users from each target who are no longer in the corporate identity feed.  Every target lists the
+// users it manages (IDCS managed group members, VBCS app users and OCE artifacts folder members) and is diffed
+// against the feed and cleaned on its own, so a failure or an exceeded removal limit in one target doesn't stop the
+// others.  Targets are cleaned in reverse order so users are removed from OCE and the VBCS apps before IDCS.
+//
+// Leavers are deprovisioned in two stages.  The first clean that finds a leaver deactivates them in every target
+// that supports it and records the date in the state file.  They are only deleted by a clean run once
+// DeprovisionGraceDays have passed, so a leaver who returns to the feed in the meantime is reactivated by the next
+// add with their group memberships intact.  Interactive runs ask for confirmation of each deactivation and removal
+// on the console.  Auto runs proceed without asking but skip any target with more pending deactivations and
+// removals than the configured removal limit allows.
+//
+func runClean(ctx context.Context, session *Session, targets []Target, people []AriaServicePerson, auto bool) *CleanReport {
+	report := &CleanReport{Generated: time.Now(), Auto: auto, Targets: []*TargetCleanReport{}}
+
+	// convert the personList to a hashmap for efficient searching
+	ariaMap := make(map[string]AriaServicePerson)
+	for _, person := range people {
+		ariaMap[strings.ToLower(strings.TrimSpace(person.UserID))] = person
+	}
+
+	for i := len(targets) - 1; i >= 0; i-- {
+		targetReport := cleanTarget(ctx, session, targets[i], ariaMap, report.Generated, auto)
+		report.Targets = append(report.Targets, targetReport)
+		if targetReport.Aborted {
+			report.Aborted = true
+		}
+	}
+
+	// forget leavers who came back or who are no longer in any target.  An aborted target may still hold leavers
+	// so nothing is forgotten unless every target was listed.
+	if !report.Aborted {
+		stale := make(map[string]bool)
+		for _, targetReport := range report.Targets {
+			for _, email := range targetReport.Stale {
+				stale[strings.ToLower(email)] = true
+			}
+		}
+		session.State.pruneLeavers(stale)
+	}
+	if err := session.State.Save(); err != nil {
+		rootLog.Errorf("Error writing state file: %s", err.Error())
+	}
+	return report
+}
+
+//
+// Deactivates or removes the users from a single target who are no longer in the corporate identity feed.  started
+// is when the clean run started so leavers first recorded by an earlier target in this run are deactivated too.
+//
+func cleanTarget(ctx context.Context, session *Session, target Target, ariaMap map[string]AriaServicePerson,
+	started time.Time, auto bool) *TargetCleanReport {
+	report := &TargetCleanReport{Target: target.Name(), Stale: []string{}, Unmanaged: []string{}, Deactivated: []string{},
+		Pending: []string{}, Removed: []string{}, Skipped: []string{}, Failed: []string{}}
+	ctx = withTarget(ctx, target.Name())
+	log := logFrom(ctx)
+	log.Infof("*** Cleaning %s", target.Name())
+
+	stale, unmanaged, err := staleIdentities(ctx, session.State, target, ariaMap)
+	if err != nil {
+		report.Aborted = true
+		report.Reason = "listing users failed: " + err.Error()
+		return report
+	}
+	for _, identity := range unmanaged {
+		report.Unmanaged = append(report.Unmanaged, identity.Email)
+	}
+
+	// work out which stage each leaver is at before touching anything so the removal limit covers this run's writes
+	graceDays := session.Config.DeprovisionGraceDays
+	if graceDays < 1 {
+		graceDays = defaultDeprovisionGraceDays
+	}
+	var deactivate, remove []*RemoteIdentity
+	for i := range stale {
+		identity := &stale[i]
+		report.Stale = append(report.Stale, identity.Email)
+		leaver := session.State.leaver(strings.ToLower(identity.Email))
+		if leaver == nil || !leaver.DeactivatedAt.Before(started) {
+			deactivate = append(deactivate, identity)
+		} else if time.Since(leaver.DeactivatedAt) >= time.Duration(graceDays)*24*time.Hour {
+			remove = append(remove, identity)
+		} else {
+			report.Pending = append(report.Pending, identity.Email)
+			session.Report.count(target.Name(), outcomeUnchanged)
+		}
+	}
+
+	if auto {
+		report.Limit = cleanRemovalLimit(session.Config, len(ariaMap))
+		if len(deactivate)+len(remove) > report.Limit {
+			report.Aborted = true
+			report.Reason = fmt.Sprintf("%d deactivations and %d removals exceed the removal limit of %d for a feed of %d people",
+				len(deactivate), len(remove), report.Limit, len(ariaMap))
+			return report
+		}
+	}
+
+	for _, identity := range deactivate {
+		if !auto && !confirm(fmt.Sprintf("** User [%s] not found in corporate identity feed.  Deactivate in %s [y/n]?",
+			identity.Email, target.Name())) {
+			log.Infof("*** Skipping deactivation of user [%s] in %s", identity.Email, target.Name())
+			report.Skipped = append(report.Skipped, identity.Email)
+			continue
+		}
+
+		log.Infof("*** Deactivating user [%s] in %s", identity.Email, target.Name())
+		person := AriaServicePerson{UserID: identity.Email, DisplayName: identity.Email}
+		if deactivator, ok := target.(Deactivator); ok {
+			if err := deactivator.Deactivate(ctx, person, identity); err != nil {
+				log.Errorf("%s", err.Error())
+				report.Failed = append(report.Failed, identity.Email)
+				session.Report.fail(target.Name(), operationDeactivate, identity.Email, err)
+				continue
+			}
+		}
+		session.State.markLeaver(strings.ToLower(identity.Email))
+		report.Deactivated = append(report.Deactivated, identity.Email)
+		session.Report.count(target.Name(), outcomeDeactivated)
+	}
+
+	for _, identity := range remove {
+		if !auto && !confirm(fmt.Sprintf("** User [%s] deactivated for more than %d days.  Remove from %s [y/n]?",
+			identity.Email, graceDays, target.Name())) {
+			log.Infof("*** Skipping removal of user [%s] from %s", identity.Email, target.Name())
+			report.Skipped = append(report.Skipped, identity.Email)
+			continue
+		}
+
+		log.Infof("*** Removing user [%s] from %s", identity.Email, target.Name())
+		person := AriaServicePerson{UserID: identity.Email, DisplayName: identity.Email}
+		if err := target.Delete(ctx, person, identity); err != nil {
+			log.Errorf("%s", err.Error())
+			report.Failed = append(report.Failed, identity.Email)
+			session.Report.fail(target.Name(), operationDelete, identity.Email, err)
+		} else {
+			session.State.forgetIdentity(target.Name(), strings.ToLower(identity.Email))
+			report.Removed = append(report.Removed, identity.Email)
+			session.Report.count(target.Name(), outcomeDeleted)
+		}
+	}
+	return report
+}
+
+//
+// Ask a yes/no question on the console and report whether it was answered yes
+//
+func confirm(question string) bool {
+	fmt.Print(question)
+	text, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	text = strings.Replace(text, "\n", "", -1)
+	return strings.Compare("Y", strings.ToUpper(text)) == 0
+}
+
+//
+// Returns the users the target holds that aren't in the corporate identity feed, split into those this tool owns
+// and may deprovision and those it never provisioned.  A target's list may only cover the population it manages
+// (e.g. the members of the managed IDCS groups), so an owned identity missing from it is looked up before being
+// forgotten; only identities that were deleted outside of this tool are forgotten.
+//
+func staleIdentities(ctx context.Context, state *StateStore, target Target,
+	ariaMap map[string]AriaServicePerson) ([]RemoteIdentity, []RemoteIdentity, error) {
+	identities, err := target.List(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var stale, unmanaged []RemoteIdentity
+	seen := make(map[string]bool)
+	for _, identity := range identities {
+		email := strings.ToLower(strings.TrimSpace(identity.Email))
+		if seen[email] {
+			continue
+		}
+		seen[email] = true
+		if _, userExistsInAria := ariaMap[email]; userExistsInAria {
+			continue
+		}
+		if state.owns(target.Name(), email) {
+			stale = append(stale, identity)
+		} else {
+			unmanaged = append(unmanaged, identity)
+		}
+	}
+
+	for _, email := range state.ownedEmails(target.Name()) {
+		if seen[email] {
+			continue
+		}
+		identity, err := target.Lookup(ctx, AriaServicePerson{UserID: email})
+		if err != nil {
+			return nil, nil, err
+		}
+		if identity == nil {
+			continue
+		}
+		seen[email] = true
+		if _, userExistsInAria := ariaMap[email]; !userExistsInAria {
+			identity.Email = email
+			stale = append(stale, *identity)
+		}
+	}
+	state.pruneIdentities(target.Name(), seen)
+	return stale, unmanaged, nil
+}
+
+//
+// Returns the most users an unattended clean may remove.  CleanMaxRemovals and CleanMaxRemovalPercent (of the
+// people in the corporate identity feed) both apply when set and the lower of the two wins.  If neither is set the
+// limit defaults to 5% of the feed.
+//
+func cleanRemovalLimit(config Config, feedSize int) int {
+	percent := config.CleanMaxRemovalPercent
+	if config.CleanMaxRemovals < 1 && percent <= 0 {
+		percent = defaultCleanMaxRemovalPercent
+	}
+
+	limit := -1
+	if config.CleanMaxRemovals > 0 {
+		limit = config.CleanMaxRemovals
+	}
+	if percent > 0 {
+		percentLimit := int(float64(feedSize) * percent / 100)
+		if limit < 0 || percentLimit < limit {
+			limit = percentLimit
+		}
+	}
+	return limit
+}
+
+//
+// Print a summary of the clean run for each target
+//
+func (report *CleanReport) print() {
+	for _, target := range report.Targets {
+		if target.Aborted {
+			log := rootLog.forTarget(target.Target)
+			log.Errorf("*** Clean of %s ABORTED, no users were deactivated or removed: %s", target.Target, target.Reason)
+			for _, email := range target.Stale {
+				log.Infof("** Stale user [%s]", email)
+			}
+			continue
+		}
+		log := rootLog.forTarget(target.Target)
+		log.Infof("*** Deactivated %d and removed %d of %d stale users from %s, %d within the grace period, %d skipped, %d failed",
+			len(target.Deactivated), len(target.Removed), len(target.Stale), target.Target, len(target.Pending),
+			len(target.Skipped), len(target.Failed))
+		for _, email := range target.Unmanaged {
+			log.Infof("** User [%s] in %s isn't in the feed but wasn't provisioned by this tool, leaving it alone", email, target.Target)
+		}
+	}
+}
+
+//
+// Write the report as indented JSON so removals can be audited or replayed
+//
+func (report *CleanReport) writeJSON(filename string) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
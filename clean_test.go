@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCleanRemovalLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		feedSize int
+		want     int
+	}{
+		{"default percent of a small feed", Config{}, 10, 0},
+		{"default percent of a large feed", Config{}, 10000, 500},
+		{"percent of a small feed", Config{CleanMaxRemovalPercent: 10}, 15, 1},
+		{"percent of a large feed", Config{CleanMaxRemovalPercent: 10}, 5000, 500},
+		{"count only", Config{CleanMaxRemovals: 25}, 10000, 25},
+		{"count wins on a large feed", Config{CleanMaxRemovals: 25, CleanMaxRemovalPercent: 10}, 5000, 25},
+		{"percent wins on a small feed", Config{CleanMaxRemovals: 25, CleanMaxRemovalPercent: 10}, 40, 4},
+		{"empty feed", Config{CleanMaxRemovals: 25}, 0, 25},
+	}
+	for _, test := range tests {
+		if got := cleanRemovalLimit(test.config, test.feedSize); got != test.want {
+			t.Errorf("%s: cleanRemovalLimit(feed of %d) = %d, want %d", test.name, test.feedSize, got, test.want)
+		}
+	}
+}
+
+func TestStaleIdentities(t *testing.T) {
+	target := &fakeTarget{name: "IDCS",
+		listed:   []string{"listed.leaver@oracle.com", "handmade@oracle.com", "stayer@oracle.com"},
+		existing: map[string]bool{"ungrouped.leaver@oracle.com": true, "ungrouped.stayer@oracle.com": true}}
+	state := &StateStore{Identities: make(map[string]map[string]*OwnedIdentity)}
+	for _, email := range []string{"listed.leaver@oracle.com", "stayer@oracle.com", "ungrouped.leaver@oracle.com",
+		"ungrouped.stayer@oracle.com", "deleted@oracle.com"} {
+		state.recordIdentity("IDCS", email, OwnedIdentity{RemoteID: "id-" + email}, true)
+	}
+	ariaMap := map[string]AriaServicePerson{
+		"stayer@oracle.com":           {UserID: "stayer@oracle.com"},
+		"ungrouped.stayer@oracle.com": {UserID: "ungrouped.stayer@oracle.com"},
+	}
+
+	stale, unmanaged, err := staleIdentities(context.Background(), state, target, ariaMap)
+	if err != nil {
+		t.Fatalf("staleIdentities returned %v", err)
+	}
+	if len(stale) != 2 || stale[0].Email != "listed.leaver@oracle.com" || stale[1].Email != "ungrouped.leaver@oracle.com" {
+		t.Errorf("stale = %+v, want the listed leaver and the leaver missing from the list", stale)
+	}
+	if len(unmanaged) != 1 || unmanaged[0].Email != "handmade@oracle.com" {
+		t.Errorf("unmanaged = %+v, want only the hand-made user", unmanaged)
+	}
+
+	tests := []struct {
+		email string
+		owned bool
+	}{
+		{"listed.leaver@oracle.com", true},
+		{"stayer@oracle.com", true},
+		{"ungrouped.leaver@oracle.com", true},
+		{"ungrouped.stayer@oracle.com", true},
+		{"deleted@oracle.com", false},
+		{"handmade@oracle.com", false},
+	}
+	for _, test := range tests {
+		if got := state.owns("IDCS", test.email); got != test.owned {
+			t.Errorf("owns(%s) = %v, want %v", test.email, got, test.owned)
+		}
+	}
+}
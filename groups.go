@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+)
+
+// GroupRule grants a list of IDCS groups to every person who matches all of the rule's conditions.  Conditions
+// that are left empty match everyone.  List conditions are comma-separated and match if any entry matches.
+type GroupRule struct {
+	Name       string
+	Lob        string // person's lob equals one of these
+	LobParent  string // person's lob_parent equals one of these
+	AppMap     string // person's app_map contains one of these app keys
+	Manager    *bool  // true matches only people with direct reports, false only people without
+	MinDirects int    // person has at least this many direct reports
+	MgrChain   string // person's mgr_chain contains one of these managers
+	Groups     string // groups granted to matching people
+}
+
+//
+// Returns the group rules for this run.  ManagerGroupNames and UserGroupNames are always honored as a manager rule
+// and an individual contributor rule, followed by any rules from the GroupRules config.
+//
+func groupRules(config Config) []GroupRule {
+	manager, contributor := true, false
+	rules := []GroupRule{
+		{Name: "ManagerGroupNames", Manager: &manager, Groups: config.ManagerGroupNames},
+		{Name: "UserGroupNames", Manager: &contributor, Groups: config.UserGroupNames},
+	}
+	return append(rules, config.GroupRules...)
+}
+
+//
+// Reports whether a person satisfies every condition of the rule
+//
+func (rule GroupRule) matches(person AriaServicePerson) bool {
+	if rule.Manager != nil && *rule.Manager != (person.NumberOfDirects > 0) {
+		return false
+	}
+	if person.NumberOfDirects < rule.MinDirects {
+		return false
+	}
+	if !matchesAny(rule.Lob, func(value string) bool { return strings.EqualFold(person.Lob, value) }) {
+		return false
+	}
+	if !matchesAny(rule.LobParent, func(value string) bool { return strings.EqualFold(person.LobParent, value) }) {
+		return false
+	}
+	if !matchesAny(rule.AppMap, func(value string) bool { return strings.Contains(person.AppMap, value) }) {
+		return false
+	}
+	if !matchesAny(rule.MgrChain, func(value string) bool {
+		return strings.Contains(strings.ToLower(person.MgrChain), strings.ToLower(value))
+	}) {
+		return false
+	}
+	return true
+}
+
+//
+// Reports whether any entry of a comma-separated condition satisfies the match function.  An empty condition
+// always matches.
+//
+func matchesAny(condition string, match func(value string) bool) bool {
+	values := splitGroupNames(condition)
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Returns the names of every group granted to the person by a matching rule
+//
+func expectedGroupNames(config Config, person AriaServicePerson) []string {
+	var groups []string
+	for _, rule := range groupRules(config) {
+		if rule.matches(person) {
+			groups = append(groups, rule.Groups)
+		}
+	}
+	return splitGroupNames(strings.Join(groups, ","))
+}
+
+//
+// Returns the names of every group this tool manages membership of, which is every group named in any rule
+//
+func managedGroupNames(config Config) []string {
+	var groups []string
+	for _, rule := range groupRules(config) {
+		groups = append(groups, rule.Groups)
+	}
+	return splitGroupNames(strings.Join(groups, ","))
+}
+
+//
+// Split a comma-separated list of names, trimming whitespace and dropping empty and duplicate names
+//
+func splitGroupNames(groupList string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, groupName := range strings.Split(groupList, ",") {
+		groupName = strings.TrimSpace(groupName)
+		if len(groupName) > 0 && !seen[groupName] {
+			seen[groupName] = true
+			names = append(names, groupName)
+		}
+	}
+	return names
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestGroupRuleMatches(t *testing.T) {
+	manager, contributor := true, false
+	lead := AriaServicePerson{Lob: "Cloud", LobParent: "Engineering", AppMap: "ecal,oce", MgrChain: "ceo,VPSmith,dirjones",
+		NumberOfDirects: 4}
+	engineer := AriaServicePerson{Lob: "cloud", LobParent: "Engineering", AppMap: "ecal", MgrChain: "ceo,vpsmith,dirjones,lead",
+		NumberOfDirects: 0}
+
+	tests := []struct {
+		name   string
+		rule   GroupRule
+		person AriaServicePerson
+		want   bool
+	}{
+		{"empty rule matches everyone", GroupRule{}, engineer, true},
+		{"manager rule matches a manager", GroupRule{Manager: &manager}, lead, true},
+		{"manager rule skips a contributor", GroupRule{Manager: &manager}, engineer, false},
+		{"contributor rule matches a contributor", GroupRule{Manager: &contributor}, engineer, true},
+		{"contributor rule skips a manager", GroupRule{Manager: &contributor}, lead, false},
+		{"enough directs", GroupRule{MinDirects: 4}, lead, true},
+		{"too few directs", GroupRule{MinDirects: 5}, lead, false},
+		{"lob ignores case", GroupRule{Lob: "CLOUD"}, engineer, true},
+		{"lob list", GroupRule{Lob: "Apps, Cloud"}, lead, true},
+		{"lob mismatch", GroupRule{Lob: "Apps"}, lead, false},
+		{"lob parent list", GroupRule{LobParent: "Sales,Engineering"}, lead, true},
+		{"lob parent mismatch", GroupRule{LobParent: "Sales"}, lead, false},
+		{"app map contains key", GroupRule{AppMap: "oce"}, lead, true},
+		{"app map missing key", GroupRule{AppMap: "oce,vbcs"}, engineer, false},
+		{"manager chain ignores case", GroupRule{MgrChain: "vpsmith"}, lead, true},
+		{"manager chain mismatch", GroupRule{MgrChain: "vpdoe"}, engineer, false},
+		{"every condition must match", GroupRule{Lob: "Cloud", AppMap: "oce", Manager: &contributor}, lead, false},
+		{"all conditions match", GroupRule{Lob: "Cloud", LobParent: "Engineering", AppMap: "ecal", MgrChain: "lead",
+			Manager: &contributor}, engineer, true},
+	}
+	for _, test := range tests {
+		if got := test.rule.matches(test.person); got != test.want {
+			t.Errorf("%s: matches = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how an HTTPClient retries failed requests.  Zero values fall back to the default policy.
+type RetryPolicy struct {
+	MaxAttempts      int
+	InitialBackoffMs int
+	MaxBackoffMs     int
+}
+
+// defaultRetryPolicy is used for any target without a policy in the RetryPolicies config
+var defaultRetryPolicy = RetryPolicy{MaxAttempts: 4, InitialBackoffMs: 500, MaxBackoffMs: 30000}
+
+// HTTPClient sends the requests for a single target and retries transient failures according to the target's
+// retry policy.  It is safe to use from many goroutines.
+type HTTPClient struct {
+	name   string
+	client *http.Client
+	policy RetryPolicy
+}
+
+// HTTPError is a failed HTTP call along with the status the server answered with, 0 when there was no response
+type HTTPError struct {
+	Status  int
+	Message string
+}
+
+func (err *HTTPError) Error() string {
+	return err.Message
+}
+
+//
+// Returns an error describing a failed HTTP call with outputHTTPError that carries the response status
+//
+func httpError(message string, err error, res *http.Response) error {
+	status := 0
+	if err == nil && res != nil {
+		status = res.StatusCode
+	}
+	return &HTTPError{Status: status, Message: outputHTTPError(message, err, res)}
+}
+
+//
+// Returns an HTTPClient for the named target using the target's entry in the RetryPolicies config, then the
+// "default" entry, then the built-in default for any value that isn't set
+//
+func NewHTTPClient(config Config, client *http.Client, name string) *HTTPClient {
+	policy := config.RetryPolicies[name].orDefaults(config.RetryPolicies["default"]).orDefaults(defaultRetryPolicy)
+	return &HTTPClient{name: name, client: client, policy: policy}
+}
+
+//
+// Fill in any unset values of a policy from a fallback policy
+//
+func (policy RetryPolicy) orDefaults(fallback RetryPolicy) RetryPolicy {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = fallback.MaxAttempts
+	}
+	if policy.InitialBackoffMs < 1 {
+		policy.InitialBackoffMs = fallback.InitialBackoffMs
+	}
+	if policy.MaxBackoffMs < 1 {
+		policy.MaxBackoffMs = fallback.MaxBackoffMs
+	}
+	return policy
+}
+
+//
+// Send a request.  Idempotent requests (GET, HEAD, PUT, DELETE, OPTIONS) are retried on network errors, 5xx and
+// 429 responses.  Other requests are only retried on 429 since the server has told us it didn't process them.
+//
+func (c *HTTPClient) Do(req *http.Request) (*http.Response, error) {
+	switch req.Method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return c.do(req, true)
+	}
+	return c.do(req, false)
+}
+
+//
+// Send a request that is known to be safe to repeat regardless of its method (for example a PATCH that adds a
+// group member or a token request), retrying it like any idempotent request
+//
+func (c *HTTPClient) DoIdempotent(req *http.Request) (*http.Response, error) {
+	return c.do(req, true)
+}
+
+func (c *HTTPClient) do(req *http.Request, idempotent bool) (*http.Response, error) {
+	backoff := time.Duration(c.policy.InitialBackoffMs) * time.Millisecond
+	maxBackoff := time.Duration(c.policy.MaxBackoffMs) * time.Millisecond
+
+	for attempt := 1; ; attempt++ {
+		// requests with a body need a fresh copy of it for every attempt after the first
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		res, err := c.send(req)
+		retryable := (err != nil && idempotent) ||
+			(res != nil && (res.StatusCode == 429 || (idempotent && res.StatusCode >= 500)))
+		if !retryable || attempt >= c.policy.MaxAttempts || (req.Body != nil && req.GetBody == nil) {
+			return res, err
+		}
+
+		// honor Retry-After when the server sends it, otherwise use jittered exponential backoff
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = res.Status
+			if retryAfter, ok := parseRetryAfter(res.Header.Get("Retry-After")); ok {
+				delay = retryAfter
+			}
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+		if delay > maxBackoff {
+			delay = maxBackoff
+		}
+
+		c.log(req).Warnf("** %s %s %s failed (%s), retrying in %s [attempt %d/%d]", c.name, req.Method,
+			req.URL.Path, reason, delay.Round(time.Millisecond), attempt+1, c.policy.MaxAttempts)
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+//
+// Send a single attempt of a request.  At debug level the request and the response are traced along with their
+// headers and bodies, so the response body is read up front and handed back in a fresh reader.
+//
+func (c *HTTPClient) send(req *http.Request) (*http.Response, error) {
+	log := c.log(req)
+	if !log.enabled(LevelDebug) {
+		return c.client.Do(req)
+	}
+
+	var body []byte
+	if req.GetBody != nil {
+		if reader, err := req.GetBody(); err == nil {
+			body, _ = ioutil.ReadAll(reader)
+			reader.Close()
+		}
+	}
+	log.Debugf("%s %s %s%s%s", c.name, req.Method, req.URL.String(), traceHeaders(req.Header), traceBody(body))
+
+	started := time.Now()
+	res, err := c.client.Do(req)
+	elapsed := time.Since(started).Round(time.Millisecond)
+	if err != nil {
+		log.Debugf("%s %s %s failed after %s: %s", c.name, req.Method, req.URL.String(), elapsed, err.Error())
+		return res, err
+	}
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	log.Debugf("%s %s %s -> %s in %s%s%s", c.name, req.Method, req.URL.String(), res.Status, elapsed,
+		traceHeaders(res.Header), traceBody(body))
+	return res, err
+}
+
+//
+// Returns the logger for a request, tagged with this client's name when the caller didn't tag it with a target
+//
+func (c *HTTPClient) log(req *http.Request) *Logger {
+	log := logFrom(req.Context())
+	if len(log.target) < 1 {
+		log = log.forTarget(c.name)
+	}
+	return log
+}
+
+//
+// Format headers for a trace line, one per line in name order
+//
+func traceHeaders(header http.Header) string {
+	var names []string
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines bytes.Buffer
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(&lines, "\n  %s: %s", name, value)
+		}
+	}
+	return lines.String()
+}
+
+//
+// Format a body for a trace line
+//
+func traceBody(body []byte) string {
+	if len(body) < 1 {
+		return ""
+	}
+	return "\n  " + string(body)
+}
+
+//
+// Parse a Retry-After header which is either a number of seconds or an HTTP date
+//
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if len(value) < 1 {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
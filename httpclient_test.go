@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"seconds", "120", 120 * time.Second, true},
+		{"zero seconds", "0", 0, true},
+		{"future date", time.Now().Add(90 * time.Second).UTC().Format(http.TimeFormat), 90 * time.Second, true},
+		{"past date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true},
+		{"empty", "", 0, false},
+		{"negative seconds", "-5", 0, false},
+		{"garbage", "soon", 0, false},
+	}
+	for _, test := range tests {
+		got, ok := parseRetryAfter(test.value)
+		if ok != test.wantOK {
+			t.Errorf("%s: parseRetryAfter(%q) ok = %v, want %v", test.name, test.value, ok, test.wantOK)
+			continue
+		}
+		// HTTP dates only carry whole seconds and time passes while the test runs
+		if diff := got - test.want; diff > time.Second || diff < -2*time.Second {
+			t.Errorf("%s: parseRetryAfter(%q) = %v, want about %v", test.name, test.value, got, test.want)
+		}
+	}
+}
+
+func TestHTTPClientRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		idempotent   bool   // sent with DoIdempotent
+		statuses     []int  // answered in order, the last one repeats
+		retryAfter   string // sent with every 429
+		wantStatus   int
+		wantAttempts int
+	}{
+		{"get retried on 5xx", "GET", false, []int{503, 500, 200}, "", 200, 3},
+		{"get not retried on 4xx", "GET", false, []int{404, 200}, "", 404, 1},
+		{"post not retried on 5xx", "POST", false, []int{503, 201}, "", 503, 1},
+		{"post retried on 429", "POST", false, []int{429, 201}, "0", 201, 2},
+		{"idempotent post retried on 5xx", "POST", true, []int{502, 200}, "", 200, 2},
+		{"patch not retried on 5xx", "PATCH", false, []int{500, 204}, "", 500, 1},
+		{"attempts capped", "DELETE", false, []int{503}, "", 503, 3},
+		{"429 capped", "PUT", false, []int{429}, "0", 429, 3},
+	}
+	for _, test := range tests {
+		attempts := 0
+		var bodies []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+			status := test.statuses[len(test.statuses)-1]
+			if attempts < len(test.statuses) {
+				status = test.statuses[attempts]
+			}
+			attempts++
+			if status == 429 {
+				w.Header().Set("Retry-After", test.retryAfter)
+			}
+			w.WriteHeader(status)
+		}))
+
+		config := Config{RetryPolicies: map[string]RetryPolicy{"TEST": {MaxAttempts: 3, InitialBackoffMs: 1, MaxBackoffMs: 5}}}
+		client := NewHTTPClient(config, http.DefaultClient, "TEST")
+		req, _ := http.NewRequestWithContext(quietContext(), test.method, server.URL, strings.NewReader("payload"))
+		send := client.Do
+		if test.idempotent {
+			send = client.DoIdempotent
+		}
+		res, err := send(req)
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode != test.wantStatus || attempts != test.wantAttempts {
+			t.Errorf("%s: got %d after %d attempts, want %d after %d", test.name, res.StatusCode, attempts,
+				test.wantStatus, test.wantAttempts)
+		}
+		for i, body := range bodies {
+			if body != "payload" {
+				t.Errorf("%s: attempt %d sent body %q", test.name, i+1, body)
+			}
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line.  Lines below the configured level are dropped.
+type Level int
+
+// Log levels, from the most to the least verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// levelNames are the names used for levels on the command line and in log lines
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// logSettings are shared by every logger of a run
+type logSettings struct {
+	level Level
+	json  bool
+	runID string
+	mutex sync.Mutex // serializes writes to stdout
+}
+
+// Logger writes leveled log lines tagged with the run ID and, when known, the user and target they are about.
+// Loggers are carried in the context so code deep inside a target logs against the person being processed.
+type Logger struct {
+	out      io.Writer
+	settings *logSettings
+	user     string
+	target   string
+}
+
+type loggerKey struct{}
+
+// rootLog writes straight to stdout and is used for run-wide output and by code that isn't processing a person
+var rootLog = &Logger{out: os.Stdout, settings: &logSettings{level: LevelInfo}}
+
+//
+// Set the level, format ("text" or "json") and run ID of every log line.  Returns an error for an unknown level
+// or format.
+//
+func configureLogging(level string, format string, runID string) error {
+	parsed, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("ERROR: unknown log format [%s], expected text or json", format)
+	}
+	rootLog.settings.level = parsed
+	rootLog.settings.json = format == "json"
+	rootLog.settings.runID = runID
+	return nil
+}
+
+//
+// Returns the level with the given name
+//
+func parseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(level), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("ERROR: unknown log level [%s], expected one of %s", name, strings.Join(levelNames, ", "))
+}
+
+//
+// Returns a context that carries the given logger
+//
+func withLogger(ctx context.Context, log *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+//
+// Returns the logger carried by the context, or the root logger if there isn't one
+//
+func logFrom(ctx context.Context) *Logger {
+	if log, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return log
+	}
+	return rootLog
+}
+
+//
+// Returns a context whose logger tags every line with the target name
+//
+func withTarget(ctx context.Context, target string) context.Context {
+	return withLogger(ctx, logFrom(ctx).forTarget(target))
+}
+
+//
+// Returns a logger for a single person whose lines are written to out, which is typically a buffer that is
+// flushed once the person is done
+//
+func (log *Logger) forUser(user string, out io.Writer) *Logger {
+	return &Logger{out: out, settings: log.settings, user: user}
+}
+
+//
+// Returns a copy of the logger that tags every line with the target name
+//
+func (log *Logger) forTarget(target string) *Logger {
+	tagged := *log
+	tagged.target = target
+	return &tagged
+}
+
+//
+// Reports whether lines at the level are written.  Used to skip building expensive debug output.
+//
+func (log *Logger) enabled(level Level) bool {
+	return level >= log.settings.level
+}
+
+func (log *Logger) Debugf(format string, args ...interface{}) {
+	log.write(LevelDebug, format, args...)
+}
+
+func (log *Logger) Infof(format string, args ...interface{}) {
+	log.write(LevelInfo, format, args...)
+}
+
+func (log *Logger) Warnf(format string, args ...interface{}) {
+	log.write(LevelWarn, format, args...)
+}
+
+func (log *Logger) Errorf(format string, args ...interface{}) {
+	log.write(LevelError, format, args...)
+}
+
+//
+// Format and write a single log line with its secrets masked.  Text lines are "time LEVEL run=... user=... target=...
+// message" and JSON lines are an object per line; the user and target are left out when they aren't known.
+//
+func (log *Logger) write(level Level, format string, args ...interface{}) {
+	if !log.enabled(level) {
+		return
+	}
+	message := redactor.redact(strings.TrimRight(fmt.Sprintf(format, args...), "\n"))
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	var line string
+	if log.settings.json {
+		var data bytes.Buffer
+		encoder := json.NewEncoder(&data)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(struct {
+			Time    string `json:"time"`
+			Level   string `json:"level"`
+			RunID   string `json:"runId"`
+			User    string `json:"user,omitempty"`
+			Target  string `json:"target,omitempty"`
+			Message string `json:"msg"`
+		}{now, levelNames[level], log.settings.runID, log.user, log.target, message})
+		line = data.String()
+	} else {
+		fields := "run=" + log.settings.runID
+		if len(log.user) > 0 {
+			fields += " user=" + log.user
+		}
+		if len(log.target) > 0 {
+			fields += " target=" + log.target
+		}
+		line = fmt.Sprintf("%s %-5s %s %s\n", now, strings.ToUpper(levelNames[level]), fields, message)
+	}
+
+	log.settings.mutex.Lock()
+	defer log.settings.mutex.Unlock()
+	io.WriteString(log.out, line)
+}
+
+//
+// Write a block of lines buffered for a single person to stdout in one piece so lines from different people never
+// interleave
+//
+func (log *Logger) flush(block []byte) {
+	log.settings.mutex.Lock()
+	defer log.settings.mutex.Unlock()
+	os.Stdout.Write(block)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// vbcsPageSize is the number of items requested per page from a VBCS business object collection
+const vbcsPageSize = 500
+
+// scimPageSize is the number of resources requested per page from an IDCS SCIM list endpoint
+const scimPageSize = 500
+
+// ocePageSize is the number of items requested per page from an OCE documents collection
+const ocePageSize = 500
+
+//
+// Calls visit for every item of a VBCS business object collection, following hasMore and offset until the last
+// page.  collectionURL may already carry query parameters.  Returning an error from visit stops paging and the
+// error is returned.
+//
+func eachVBCSItem(ctx context.Context, client *HTTPClient, collectionURL string, authorize func(*http.Request) error,
+	action string, visit func(item gjson.Result) error) error {
+	for offset := 0; ; {
+		pageURL := fmt.Sprintf("%s%slimit=%d&offset=%d", collectionURL, querySeparator(collectionURL), vbcsPageSize, offset)
+		page, err := getPage(ctx, client, pageURL, authorize, action)
+		if err != nil {
+			return err
+		}
+
+		items := page.Get("items").Array()
+		for _, item := range items {
+			if err := visit(item); err != nil {
+				return err
+			}
+		}
+		if !page.Get("hasMore").Bool() || len(items) < 1 {
+			return nil
+		}
+		offset += len(items)
+	}
+}
+
+//
+// Calls visit for every resource of an IDCS SCIM list response, following startIndex and itemsPerPage until
+// totalResults have been read.  listURL may already carry a filter or other query parameters.  Returning an error
+// from visit stops paging and the error is returned.
+//
+func eachSCIMResource(ctx context.Context, client *HTTPClient, listURL string, authorize func(*http.Request) error,
+	action string, visit func(resource gjson.Result) error) error {
+	for startIndex := 1; ; {
+		pageURL := fmt.Sprintf("%s%sstartIndex=%d&count=%d", listURL, querySeparator(listURL), startIndex, scimPageSize)
+		page, err := getPage(ctx, client, pageURL, authorize, action)
+		if err != nil {
+			return err
+		}
+
+		resources := page.Get("Resources").Array()
+		for _, resource := range resources {
+			if err := visit(resource); err != nil {
+				return err
+			}
+		}
+
+		itemsPerPage := int(page.Get("itemsPerPage").Int())
+		if itemsPerPage < 1 {
+			itemsPerPage = len(resources)
+		}
+		startIndex += itemsPerPage
+		if len(resources) < 1 || int64(startIndex) > page.Get("totalResults").Int() {
+			return nil
+		}
+	}
+}
+
+//
+// Calls visit for every item of an OCE documents collection, following offset until totalResults have been read,
+// hasMore is false or a page comes back empty.  The server may return fewer items than requested, so the offset
+// advances by the items actually read.  Returning an error from visit stops paging and the error is returned.
+//
+func eachOCEItem(ctx context.Context, client *HTTPClient, collectionURL string, authorize func(*http.Request) error,
+	action string, visit func(item gjson.Result) error) error {
+	for offset := 0; ; {
+		pageURL := fmt.Sprintf("%s%slimit=%d&offset=%d", collectionURL, querySeparator(collectionURL), ocePageSize, offset)
+		page, err := getPage(ctx, client, pageURL, authorize, action)
+		if err != nil {
+			return err
+		}
+
+		items := page.Get("items").Array()
+		for _, item := range items {
+			if err := visit(item); err != nil {
+				return err
+			}
+		}
+		offset += len(items)
+		total, hasMore := page.Get("totalResults"), page.Get("hasMore")
+		if len(items) < 1 || (total.Exists() && int64(offset) >= total.Int()) || (hasMore.Exists() && !hasMore.Bool()) {
+			return nil
+		}
+	}
+}
+
+//
+// Returns the only item of a VBCS collection query, nil if nothing matched or an error if the query unexpectedly
+// matched more than one item
+//
+func singleVBCSItem(ctx context.Context, client *HTTPClient, queryURL string, authorize func(*http.Request) error,
+	action string) (*gjson.Result, error) {
+	var match *gjson.Result
+	err := eachVBCSItem(ctx, client, queryURL, authorize, action, func(item gjson.Result) error {
+		if match != nil {
+			return fmt.Errorf("ERROR: %s: query matched more than one item", action)
+		}
+		match = &item
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return match, nil
+}
+
+//
+// Returns the only resource matching a SCIM filter, nil if nothing matched or an error if the filter unexpectedly
+// matched more than one resource
+//
+func singleSCIMResource(ctx context.Context, client *HTTPClient, listURL string, authorize func(*http.Request) error,
+	action string) (*gjson.Result, error) {
+	var match *gjson.Result
+	err := eachSCIMResource(ctx, client, listURL, authorize, action, func(resource gjson.Result) error {
+		if match != nil {
+			return fmt.Errorf("ERROR: %s: filter matched more than one resource", action)
+		}
+		match = &resource
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return match, nil
+}
+
+//
+// Fetch a single page of a collection and parse it
+//
+func getPage(ctx context.Context, client *HTTPClient, pageURL string, authorize func(*http.Request) error,
+	action string) (gjson.Result, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", pageURL, nil)
+	if err := authorize(req); err != nil {
+		return gjson.Result{}, err
+	}
+	res, err := client.Do(req)
+	if err != nil || res == nil || res.StatusCode != 200 {
+		return gjson.Result{}, httpError(action, err, res)
+	}
+	defer res.Body.Close()
+
+	json, _ := ioutil.ReadAll(res.Body)
+	return gjson.Parse(string(json)), nil
+}
+
+//
+// Returns the separator needed to append another query parameter to a URL
+//
+func querySeparator(rawURL string) string {
+	if strings.Contains(rawURL, "?") {
+		return "&"
+	}
+	return "?"
+}
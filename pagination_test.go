@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// pagedServer serves total numbered items, never more than pageCap per page however many were asked for
+func pagedServer(t *testing.T, total int, pageCap int, page func(items []int, first int) interface{}) (*httptest.Server, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		query := r.URL.Query()
+		first, size := 0, 0
+		if query.Get("startIndex") != "" {
+			first, _ = strconv.Atoi(query.Get("startIndex"))
+			first--
+			size, _ = strconv.Atoi(query.Get("count"))
+		} else {
+			first, _ = strconv.Atoi(query.Get("offset"))
+			size, _ = strconv.Atoi(query.Get("limit"))
+		}
+		if size > pageCap {
+			size = pageCap
+		}
+		var items []int
+		for i := first; i < total && i < first+size; i++ {
+			items = append(items, i)
+		}
+		json.NewEncoder(w).Encode(page(items, first))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestEachSCIMResource(t *testing.T) {
+	tests := []struct {
+		name         string
+		total        int
+		pageCap      int
+		wantRequests int
+	}{
+		{"empty", 0, 50, 1},
+		{"single page", 3, 50, 1},
+		{"capped pages", 5, 2, 3},
+		{"exact pages", 4, 2, 2},
+	}
+	for _, test := range tests {
+		server, requests := pagedServer(t, test.total, test.pageCap, func(items []int, first int) interface{} {
+			resources := []map[string]int{}
+			for _, item := range items {
+				resources = append(resources, map[string]int{"id": item})
+			}
+			return map[string]interface{}{"totalResults": test.total, "startIndex": first + 1,
+				"itemsPerPage": len(items), "Resources": resources}
+		})
+		client := NewHTTPClient(Config{}, http.DefaultClient, "TEST")
+		var visited []int64
+		err := eachSCIMResource(context.Background(), client, server.URL+"/Users?filter=x", noAuthorization, "Listing",
+			func(resource gjson.Result) error {
+				visited = append(visited, resource.Get("id").Int())
+				return nil
+			})
+		checkVisited(t, test.name, err, visited, test.total)
+		if *requests != test.wantRequests {
+			t.Errorf("%s: made %d requests, want %d", test.name, *requests, test.wantRequests)
+		}
+	}
+}
+
+func TestEachVBCSItem(t *testing.T) {
+	tests := []struct {
+		name         string
+		total        int
+		pageCap      int
+		wantRequests int
+	}{
+		{"empty", 0, 50, 1},
+		{"single page", 3, 50, 1},
+		{"capped pages", 5, 2, 3},
+		{"exact pages", 4, 2, 2},
+	}
+	for _, test := range tests {
+		server, requests := pagedServer(t, test.total, test.pageCap, func(items []int, first int) interface{} {
+			page := []map[string]int{}
+			for _, item := range items {
+				page = append(page, map[string]int{"id": item})
+			}
+			return map[string]interface{}{"items": page, "count": len(items), "offset": first,
+				"hasMore": first+len(items) < test.total}
+		})
+		client := NewHTTPClient(Config{}, http.DefaultClient, "TEST")
+		var visited []int64
+		err := eachVBCSItem(context.Background(), client, server.URL+"/Users", noAuthorization, "Listing",
+			func(item gjson.Result) error {
+				visited = append(visited, item.Get("id").Int())
+				return nil
+			})
+		checkVisited(t, test.name, err, visited, test.total)
+		if *requests != test.wantRequests {
+			t.Errorf("%s: made %d requests, want %d", test.name, *requests, test.wantRequests)
+		}
+	}
+}
+
+func noAuthorization(*http.Request) error {
+	return nil
+}
+
+// checkVisited fails the test unless every item from 0 to total-1 was visited once, in order
+func checkVisited(t *testing.T, name string, err error, visited []int64, total int) {
+	t.Helper()
+	if err != nil {
+		t.Errorf("%s: unexpected error %v", name, err)
+		return
+	}
+	if len(visited) != total {
+		t.Errorf("%s: visited %d items, want %d", name, len(visited), total)
+		return
+	}
+	for i, id := range visited {
+		if id != int64(i) {
+			t.Errorf("%s: item %d has id %d", name, i, id)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// planned change actions
+const (
+	PlanCreate      = "create"
+	PlanUpdate      = "update"
+	PlanGroupAdd    = "group-add"
+	PlanGroupRemove = "group-remove"
+	PlanGroupCreate = "group-create"
+	PlanShare       = "share"
+	PlanSync        = "sync"
+)
+
+// plannedUserID stands in for the IDCS ID of a user that would be created by this run
+const plannedUserID = "<planned>"
+
+// plannedGroupID prefixes the name of a group that would be created by this run to stand in for its IDCS ID
+const plannedGroupID = "<planned>:"
+
+// PlannedChange is a single write that would be sent to a target system if this were a real run
+type PlannedChange struct {
+	UserID      string `json:"userId"`
+	DisplayName string `json:"displayName"`
+	Target      string `json:"target"`
+	Action      string `json:"action"`
+	Detail      string `json:"detail,omitempty"`
+}
+
+// Plan collects every change a --plan run would have made in IDCS/VBCS/OCE
+type Plan struct {
+	Generated time.Time       `json:"generated"`
+	Changes   []PlannedChange `json:"changes"`
+
+	mutex sync.Mutex
+}
+
+//
+// NewPlan returns an empty plan stamped with the current time
+//
+func NewPlan() *Plan {
+	return &Plan{Generated: time.Now(), Changes: []PlannedChange{}}
+}
+
+//
+// Record a change that is being held back for the given person and target.  Safe to call from many workers.
+//
+func (plan *Plan) add(ctx context.Context, person AriaServicePerson, target string, action string, detail string) {
+	plan.mutex.Lock()
+	defer plan.mutex.Unlock()
+	plan.Changes = append(plan.Changes, PlannedChange{
+		UserID:      person.UserID,
+		DisplayName: person.DisplayName,
+		Target:      target,
+		Action:      action,
+		Detail:      detail,
+	})
+	logFrom(ctx).forTarget(target).Infof("** PLAN: %s %s -> %s", target, action, detail)
+}
+
+//
+// Print the plan grouped by user and then by target, preserving the order in which users were processed
+//
+func (plan *Plan) print() {
+	rootLog.Infof("*** Planned changes: %d", len(plan.Changes))
+
+	var users []string
+	byUser := make(map[string][]PlannedChange)
+	for _, change := range plan.Changes {
+		if _, seen := byUser[change.UserID]; !seen {
+			users = append(users, change.UserID)
+		}
+		byUser[change.UserID] = append(byUser[change.UserID], change)
+	}
+
+	for _, user := range users {
+		changes := byUser[user]
+		if len(user) > 0 {
+			rootLog.Infof("* %s (%s)", changes[0].DisplayName, user)
+		} else {
+			rootLog.Infof("* (run-wide)")
+		}
+
+		var targets []string
+		byTarget := make(map[string][]PlannedChange)
+		for _, change := range changes {
+			if _, seen := byTarget[change.Target]; !seen {
+				targets = append(targets, change.Target)
+			}
+			byTarget[change.Target] = append(byTarget[change.Target], change)
+		}
+		for _, target := range targets {
+			rootLog.Infof("  %s", target)
+			for _, change := range byTarget[target] {
+				rootLog.Infof("    %-9s %s", change.Action, change.Detail)
+			}
+		}
+	}
+}
+
+//
+// Write the plan as indented JSON so it can be reviewed before a real run.  Request payloads are written with their
+// secrets masked.
+//
+func (plan *Plan) writeJSON(filename string) error {
+	redacted := &Plan{Generated: plan.Generated}
+	for _, change := range plan.Changes {
+		change.Detail = redactor.redact(change.Detail)
+		redacted.Changes = append(redacted.Changes, change)
+	}
+	data, err := json.MarshalIndent(redacted, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// Inventory is every identity a target manages, read once with the target's paged List and indexed by email
+type Inventory struct {
+	byEmail map[string]*RemoteIdentity
+}
+
+// Differ is implemented by targets that can tell from an inventoried record alone whether a person's record
+// needs an update.  Targets that don't implement it are updated every run.
+type Differ interface {
+	NeedsUpdate(person AriaServicePerson, existing *RemoteIdentity) bool
+}
+
+// pendingChange is a single create or update the reconciler found to be needed for a person
+type pendingChange struct {
+	target   Target
+	existing *RemoteIdentity // nil when the person isn't in the target's inventory
+}
+
+// Reconciler diffs the corporate identity feed against the inventories of a set of targets in memory so only the
+// people who need a change are processed, rather than looking every person up in every target
+type Reconciler struct {
+	targets     []Target
+	inventories map[string]*Inventory
+	session     *Session
+}
+
+//
+// Reads the inventory of every target.  Any error means the targets can't be diffed and is returned.
+//
+func NewReconciler(ctx context.Context, targets []Target, session *Session) (*Reconciler, error) {
+	reconciler := &Reconciler{targets: targets, inventories: make(map[string]*Inventory), session: session}
+	for _, target := range targets {
+		ctx := withTarget(ctx, target.Name())
+		identities, err := target.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		inventory := &Inventory{byEmail: make(map[string]*RemoteIdentity)}
+		for i := range identities {
+			inventory.byEmail[strings.ToLower(identities[i].Email)] = &identities[i]
+		}
+		reconciler.inventories[target.Name()] = inventory
+		logFrom(ctx).Infof("*** Read %d users from %s", len(identities), target.Name())
+	}
+	return reconciler, nil
+}
+
+//
+// Returns the person's record from the target's inventory or nil if they aren't in it
+//
+func (r *Reconciler) find(target Target, person AriaServicePerson) *RemoteIdentity {
+	return r.inventories[target.Name()].byEmail[strings.ToLower(strings.TrimSpace(person.UserID))]
+}
+
+//
+// Computes the changes every person needs.  Returns the people who need at least one change, in feed order and
+// with their manager DN already converted to an email address, along with their changes keyed by user ID.
+// Records that are already in sync are adopted into the state store as owned by this tool.
+//
+func (r *Reconciler) diff(people []AriaServicePerson) ([]AriaServicePerson, map[string][]pendingChange) {
+	var changed []AriaServicePerson
+	changes := make(map[string][]pendingChange)
+	for _, person := range people {
+		person.Manager = convertManagerDnToEmail(person.Manager)
+
+		var pending []pendingChange
+		for _, target := range r.targets {
+			if !target.Applies(person) {
+				continue
+			}
+			existing := r.find(target, person)
+			if differ, ok := target.(Differ); ok && existing != nil && !differ.NeedsUpdate(person, existing) {
+				r.record(target, person, existing, false, false)
+				r.session.Report.count(target.Name(), outcomeUnchanged)
+				continue
+			}
+			pending = append(pending, pendingChange{target: target, existing: existing})
+		}
+
+		if len(pending) > 0 {
+			changed = append(changed, person)
+			changes[person.UserID] = pending
+		}
+	}
+	return changed, changes
+}
+
+//
+// Sends the writes for a person's pending changes.  An inventory only covers the users a target manages, so a
+// person missing from it is looked up before being created in case they already exist outside the managed
+// population.  An update that turns out to have nothing to write is counted as unchanged.  If a change fails then
+// it is queued for --retry-failed and the error is returned so the caller can continue on to the next user.
+//
+func (r *Reconciler) apply(ctx context.Context, person AriaServicePerson, changes []pendingChange) error {
+	for _, change := range changes {
+		ctx := withTarget(ctx, change.target.Name())
+		var err error
+		existing := change.existing
+		if existing == nil {
+			existing, err = change.target.Lookup(ctx, person)
+		}
+		created, written := false, true
+		if err == nil && existing == nil {
+			existing, created, err = createOrAdopt(ctx, change.target, person)
+		} else if err == nil {
+			written, err = change.target.Update(ctx, person, existing)
+		}
+
+		trackOperation(ctx, r.session, change.target, operationSync, person, err)
+		if err != nil {
+			// a record this run created is owned even when a later step failed, so clean can still remove it
+			if created {
+				r.record(change.target, person, existing, true, true)
+			}
+			logFrom(ctx).Errorf("Error processing user in %s, continuing to next user...", change.target.Name())
+			return err
+		}
+		r.record(change.target, person, existing, created, written)
+		if !written {
+			r.session.Report.count(change.target.Name(), outcomeUnchanged)
+		} else if r.session.Plan != nil {
+			r.session.Report.count(change.target.Name(), outcomePlanned)
+		} else if created {
+			r.session.Report.count(change.target.Name(), outcomeCreated)
+		} else {
+			r.session.Report.count(change.target.Name(), outcomeUpdated)
+		}
+	}
+	return nil
+}
+
+//
+// Record the person's identity in the target as owned by this tool.  written is set when this run created or
+// updated the identity rather than finding it in sync.
+//
+func (r *Reconciler) record(target Target, person AriaServicePerson, existing *RemoteIdentity, created bool, written bool) {
+	if r.session.State == nil || existing == nil {
+		return
+	}
+	identity := OwnedIdentity{RemoteID: existing.ID, Created: created, AttributesHash: attributesHash(person)}
+	if entitler, ok := target.(Entitler); ok {
+		identity.Entitlements = entitler.Entitlements(person)
+	}
+	r.session.State.recordIdentity(target.Name(), strings.ToLower(strings.TrimSpace(person.UserID)), identity, written)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// fakeTarget is a target whose inventory is fixed and whose writes only record what they were asked to do
+type fakeTarget struct {
+	name      string
+	appMapKey string
+	stale     map[string]bool // emails whose inventoried records differ from the feed
+	listed    []string        // emails List returns
+	existing  map[string]bool // emails Lookup finds
+	written   bool            // what Update reports
+	createErr error           // returned by Create along with the created record, like a failed IDCS group add
+	created   []string
+	updated   []string
+}
+
+func (t *fakeTarget) Name() string { return t.name }
+
+func (t *fakeTarget) Applies(person AriaServicePerson) bool {
+	return len(t.appMapKey) < 1 || person.AppMap == t.appMapKey
+}
+
+func (t *fakeTarget) Lookup(ctx context.Context, person AriaServicePerson) (*RemoteIdentity, error) {
+	if !t.existing[person.UserID] {
+		return nil, nil
+	}
+	return &RemoteIdentity{ID: "id-" + person.UserID, Email: person.UserID}, nil
+}
+
+func (t *fakeTarget) Create(ctx context.Context, person AriaServicePerson) (*RemoteIdentity, error) {
+	t.created = append(t.created, person.UserID)
+	return &RemoteIdentity{ID: "new-" + person.UserID, Email: person.UserID}, t.createErr
+}
+
+func (t *fakeTarget) Update(ctx context.Context, person AriaServicePerson, existing *RemoteIdentity) (bool, error) {
+	t.updated = append(t.updated, person.UserID)
+	return t.written, nil
+}
+
+func (t *fakeTarget) Delete(ctx context.Context, person AriaServicePerson, existing *RemoteIdentity) error {
+	return nil
+}
+
+func (t *fakeTarget) List(ctx context.Context) ([]RemoteIdentity, error) {
+	var identities []RemoteIdentity
+	for _, email := range t.listed {
+		identities = append(identities, RemoteIdentity{ID: "id-" + email, Email: email})
+	}
+	return identities, nil
+}
+
+func (t *fakeTarget) NeedsUpdate(person AriaServicePerson, existing *RemoteIdentity) bool {
+	return t.stale[person.UserID]
+}
+
+// newTestReconciler returns a reconciler over the targets with each target's inventory holding the given emails
+func newTestReconciler(state *StateStore, inventory map[string][]string, targets ...Target) *Reconciler {
+	session := &Session{Report: NewRunReport("test", ADD, ""), State: state}
+	r := &Reconciler{targets: targets, inventories: make(map[string]*Inventory), session: session}
+	for _, target := range targets {
+		r.inventories[target.Name()] = &Inventory{byEmail: make(map[string]*RemoteIdentity)}
+		for _, email := range inventory[target.Name()] {
+			r.inventories[target.Name()].byEmail[email] = &RemoteIdentity{ID: "id-" + email, Email: email}
+		}
+	}
+	return r
+}
+
+func TestReconcilerDiff(t *testing.T) {
+	idcs := &fakeTarget{name: "IDCS", stale: map[string]bool{"bob@oracle.com": true}}
+	ecal := &fakeTarget{name: "ECAL", appMapKey: "ECAL"}
+	state := &StateStore{Identities: make(map[string]map[string]*OwnedIdentity)}
+	r := newTestReconciler(state, map[string][]string{
+		"IDCS": {"jane@oracle.com", "bob@oracle.com"},
+		"ECAL": {"jane@oracle.com"},
+	}, idcs, ecal)
+
+	people := []AriaServicePerson{
+		{UserID: "jane@oracle.com", AppMap: "ECAL"},
+		{UserID: "bob@oracle.com", Manager: "cn=JANE_DOE,l=amer,dc=oracle,dc=com"},
+		{UserID: " Carol@Oracle.com", AppMap: "ECAL"},
+		{UserID: "dave@oracle.com", AppMap: "STS"},
+	}
+	changed, changes := r.diff(people)
+
+	tests := []struct {
+		user        string
+		wantTargets []string
+		wantFound   []bool // whether each change found the person in the target's inventory
+	}{
+		{"jane@oracle.com", nil, nil},
+		{"bob@oracle.com", []string{"IDCS"}, []bool{true}},
+		{" Carol@Oracle.com", []string{"IDCS", "ECAL"}, []bool{false, false}},
+		{"dave@oracle.com", []string{"IDCS"}, []bool{false}},
+	}
+	for _, test := range tests {
+		pending := changes[test.user]
+		if len(pending) != len(test.wantTargets) {
+			t.Errorf("%s: %d changes, want %d", test.user, len(pending), len(test.wantTargets))
+			continue
+		}
+		for i, change := range pending {
+			if change.target.Name() != test.wantTargets[i] || (change.existing != nil) != test.wantFound[i] {
+				t.Errorf("%s: change %d is %s (found %v), want %s (found %v)", test.user, i, change.target.Name(),
+					change.existing != nil, test.wantTargets[i], test.wantFound[i])
+			}
+		}
+	}
+
+	var order []string
+	for _, person := range changed {
+		order = append(order, person.UserID)
+	}
+	if len(changed) != 3 || changed[0].UserID != "bob@oracle.com" || changed[1].UserID != " Carol@Oracle.com" {
+		t.Errorf("changed people are %q, want bob, carol and dave in feed order", order)
+	} else if changed[0].Manager != "jane.doe@oracle.com" {
+		t.Errorf("manager DN converted to %q, want jane.doe@oracle.com", changed[0].Manager)
+	}
+
+	if counts := r.session.Report.Targets["IDCS"]; counts == nil || counts.Unchanged != 1 {
+		t.Errorf("IDCS counts %+v, want jane counted as unchanged", counts)
+	}
+	if !state.owns("IDCS", "jane@oracle.com") || !state.owns("ECAL", "jane@oracle.com") {
+		t.Errorf("jane's in-sync records weren't adopted into the state store")
+	}
+}
+
+func TestReconcilerApplyCountsWrites(t *testing.T) {
+	tests := []struct {
+		name    string
+		found   bool
+		written bool
+		want    TargetCounts
+	}{
+		{"create", false, true, TargetCounts{Created: 1}},
+		{"update that wrote", true, true, TargetCounts{Updated: 1}},
+		{"update with nothing to write", true, false, TargetCounts{Unchanged: 1}},
+	}
+	for _, test := range tests {
+		target := &fakeTarget{name: "ECAL", written: test.written}
+		r := newTestReconciler(nil, nil, target)
+		change := pendingChange{target: target}
+		if test.found {
+			change.existing = &RemoteIdentity{ID: "id-1", Email: "jane@oracle.com"}
+		}
+		if err := r.apply(context.Background(), AriaServicePerson{UserID: "jane@oracle.com"}, []pendingChange{change}); err != nil {
+			t.Errorf("%s: apply returned %v", test.name, err)
+			continue
+		}
+		if got := *r.session.Report.Targets["ECAL"]; got != test.want {
+			t.Errorf("%s: counted %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestIDCSNeedsUpdateComparesGroupIDs(t *testing.T) {
+	config := Config{ManagerGroupNames: "Prod_Managers", UserGroupNames: "Prod_Users"}
+	target := &idcsTarget{session: &Session{Config: config},
+		groupIDs: map[string]string{"Prod_Managers": "g-managers", "Prod_Users": "g-users"}}
+	person := AriaServicePerson{UserID: "jane@oracle.com", FirstName: "Jane", LastName: "Doe"}
+
+	tests := []struct {
+		name   string
+		groups string
+		want   bool
+	}{
+		{"in sync", `[{"value":"g-users","display":"Prod_Users"}]`, false},
+		{"display name in another case", `[{"value":"g-users","display":"PROD_USERS"}]`, false},
+		{"unmanaged group as well", `[{"value":"g-users","display":"Prod_Users"},{"value":"g-other","display":"Other"}]`, false},
+		{"missing expected group", `[{"value":"g-other","display":"Prod_Users"}]`, true},
+		{"still in a group they left", `[{"value":"g-users","display":"Prod_Users"},{"value":"g-managers","display":"Prod_Managers"}]`, true},
+	}
+	for _, test := range tests {
+		existing := &RemoteIdentity{ID: "u1", Email: person.UserID,
+			Data: gjson.Parse(`{"active":true,"name":{"givenName":"Jane","familyName":"Doe"},"groups":` + test.groups + `}`)}
+		if got := target.NeedsUpdate(person, existing); got != test.want {
+			t.Errorf("%s: NeedsUpdate = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReconcilerApplyRecordsCreatedUserOnError(t *testing.T) {
+	target := &fakeTarget{name: "IDCS", createErr: errors.New("ERROR: Adding user to IDCS group [Usr1]")}
+	state := &StateStore{Identities: make(map[string]map[string]*OwnedIdentity), Failures: make(map[string]*FailedOperation),
+		maxAttempts: defaultRetryFailedMaxAttempts}
+	r := newTestReconciler(state, nil, target)
+
+	err := r.apply(context.Background(), AriaServicePerson{UserID: "jane@oracle.com"}, []pendingChange{{target: target}})
+	if err != target.createErr {
+		t.Fatalf("apply returned %v, want the group add error", err)
+	}
+	owned := state.Identities["IDCS"]["jane@oracle.com"]
+	if owned == nil || !owned.Created || owned.RemoteID != "new-jane@oracle.com" {
+		t.Errorf("created user recorded as %+v, want owned with Created and the new ID", owned)
+	}
+	if len(state.failures()) != 1 {
+		t.Errorf("%d failures queued, want the sync queued for --retry-failed", len(state.failures()))
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/base64"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// redactedMask replaces every secret in output
+const redactedMask = "[REDACTED]"
+
+// minSecretLength is the shortest value masked wherever it appears.  Shorter values would mask ordinary words.
+const minSecretLength = 4
+
+// secretPatterns find credentials by their shape rather than their value: Authorization headers and the token and
+// password fields of JSON and form bodies.  The first group of each match is kept.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(authorization"?\s*[:=]\s*"?)[^"\r\n]+`),
+	regexp.MustCompile(`(?i)("(?:access_token|refresh_token|id_token|client_secret|password)"\s*:\s*")[^"]*`),
+	regexp.MustCompile(`(?i)(\b(?:access_token|refresh_token|id_token|client_secret|password)=)[^&\s]+`),
+}
+
+// credentialPattern finds bearer and basic credentials outside of an Authorization header.  The credential is only
+// masked when it is shaped like a token (see looksLikeToken) so server messages such as "Basic authentication
+// required" are kept.
+var credentialPattern = regexp.MustCompile(`(?i)(\b(?:bearer|basic)\s+)([A-Za-z0-9\-._~+/]{8,}=*)`)
+
+// Redactor masks secrets in text before it is logged, returned in an error or written to a report.  It knows the
+// secret values loaded with the configuration and the tokens fetched during the run.  It is safe to use from many
+// goroutines.
+type Redactor struct {
+	secrets []string // longest first so a secret containing another is masked whole
+	mutex   sync.RWMutex
+}
+
+// redactor masks the secrets of the whole run
+var redactor = &Redactor{}
+
+//
+// Mask every occurrence of the value from now on.  Values that are too short to mask safely are ignored.
+//
+func (r *Redactor) add(value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < minSecretLength {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, secret := range r.secrets {
+		if secret == value {
+			return
+		}
+	}
+	r.secrets = append(r.secrets, value)
+	sort.SliceStable(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+}
+
+//
+// Mask the password of a basic-auth credential along with the encoded username:password pair that is sent in the
+// Authorization header, since servers sometimes echo it back
+//
+func (r *Redactor) addBasicAuth(username string, password string) {
+	if len(password) < 1 {
+		return
+	}
+	r.add(password)
+	r.add(base64.StdEncoding.EncodeToString([]byte(username + ":" + password)))
+}
+
+//
+// Returns the text with every known secret and anything that looks like a credential masked
+//
+func (r *Redactor) redact(text string) string {
+	r.mutex.RLock()
+	for _, secret := range r.secrets {
+		text = strings.ReplaceAll(text, secret, redactedMask)
+	}
+	r.mutex.RUnlock()
+
+	for _, pattern := range secretPatterns {
+		text = pattern.ReplaceAllString(text, "${1}"+redactedMask)
+	}
+	return credentialPattern.ReplaceAllStringFunc(text, func(match string) string {
+		groups := credentialPattern.FindStringSubmatch(match)
+		if !looksLikeToken(groups[2]) {
+			return match
+		}
+		return groups[1] + redactedMask
+	})
+}
+
+//
+// Reports whether a word following Bearer or Basic is a credential rather than prose.  Base64 credentials carry
+// digits, "+", "/" or "=" padding and JWTs are three dot-separated parts, none of which ordinary words have.
+//
+func looksLikeToken(value string) bool {
+	return strings.ContainsAny(value, "0123456789+/=") || strings.Count(value, ".") == 2
+}
+
+//
+// Register the secrets of a loaded configuration: every credential field and every value read from the OCI
+// Secrets Service.  vaulted holds the values that came from the vault.
+//
+func registerConfigSecrets(config Config, vaulted []string) {
+	for _, value := range vaulted {
+		redactor.add(value)
+	}
+	redactor.addBasicAuth(config.IdcsClientID, config.IdcsClientSecret)
+	redactor.addBasicAuth(config.AriaServiceUsername, config.AriaServicePassword)
+	redactor.addBasicAuth(config.VbcsUsername, config.VbcsPassword)
+	redactor.addBasicAuth(config.OceUsername, config.OcePassword)
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestRedact(t *testing.T) {
+	r := &Redactor{}
+	r.add("vaulted-secret-value\n")
+	r.addBasicAuth("client-id", "client-secret-1")
+	r.add("abc")
+
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"config secret", `ERROR: detail ->{"echo":"client-secret-1"}`, `ERROR: detail ->{"echo":"[REDACTED]"}`},
+		{"vaulted secret", "value vaulted-secret-value leaked", "value [REDACTED] leaked"},
+		{"basic auth echo", `{"auth":"Y2xpZW50LWlkOmNsaWVudC1zZWNyZXQtMQ=="}`, `{"auth":"[REDACTED]"}`},
+		{"bearer token", "sent Bearer eyJhbGciOiJSUzI1NiJ9.payload.signature to IDCS", "sent Bearer [REDACTED] to IDCS"},
+		{"authorization header", "  Authorization: Basic Zm9vOmJhcg==", "  Authorization: [REDACTED]"},
+		{"authorization json field", `{"Authorization": "Bearer abcdefghijkl"}`, `{"Authorization": "[REDACTED]"}`},
+		{"json password", `{"userName":"jane","password": "p@ss word"}`, `{"userName":"jane","password": "[REDACTED]"}`},
+		{"json client secret", `{"client_secret":"s3cr3t"}`, `{"client_secret":"[REDACTED]"}`},
+		{"form client secret", "grant_type=client_credentials&client_secret=s3cr3t&scope=x",
+			"grant_type=client_credentials&client_secret=[REDACTED]&scope=x"},
+		{"json access token", `{"access_token": "tok-123", "expires_in": 3600}`, `{"access_token": "[REDACTED]", "expires_in": 3600}`},
+		{"plain text", "IDCS bearer token not retrieved", "IDCS bearer token not retrieved"},
+		{"basic in prose", "Basic auth failed for user abc@oracle.com", "Basic auth failed for user abc@oracle.com"},
+		{"basic word", `{"detail":"Basic authentication required"}`, `{"detail":"Basic authentication required"}`},
+		{"bearer word", "401: Bearer authorization failed", "401: Bearer authorization failed"},
+		{"basic credential", "echoed Basic YWJjOmRlZg== back", "echoed Basic [REDACTED] back"},
+		{"jwt shape", "got Bearer header.payload.signature", "got Bearer [REDACTED]"},
+	}
+	for _, test := range tests {
+		if got := r.redact(test.text); got != test.want {
+			t.Errorf("%s: redact(%q) = %q, want %q", test.name, test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes of an operation on a person in a target, counted per target in the run report
+const (
+	outcomeCreated     = "created"
+	outcomeUpdated     = "updated"
+	outcomeUnchanged   = "unchanged"
+	outcomeDeactivated = "deactivated"
+	outcomeDeleted     = "deleted"
+	outcomeFailed      = "failed"
+	outcomePlanned     = "planned" // a create or update a --plan run would have made
+)
+
+// RunReport is the machine readable outcome of a single invocation, written as JSON when the run exits so it can
+// be ingested by monitoring.  It is safe to update from many workers.
+type RunReport struct {
+	RunID      string                   `json:"runId"`
+	Mode       string                   `json:"mode"`
+	Started    time.Time                `json:"started"`
+	Finished   time.Time                `json:"finished"`
+	ExitStatus int                      `json:"exitStatus"`
+	FeedSize   int                      `json:"feedSize"`
+	Targets    map[string]*TargetCounts `json:"targets"`
+	Failures   []UserFailure            `json:"failures"`
+
+	filename string
+	mutex    sync.Mutex
+}
+
+// TargetCounts counts the outcome of every operation on a person in a single target
+type TargetCounts struct {
+	Created     int `json:"created"`
+	Updated     int `json:"updated"`
+	Unchanged   int `json:"unchanged"`
+	Deactivated int `json:"deactivated"`
+	Deleted     int `json:"deleted"`
+	Failed      int `json:"failed"`
+	Planned     int `json:"planned"`
+}
+
+// UserFailure is a single failed operation on a person in a target
+type UserFailure struct {
+	User      string `json:"user"`
+	Target    string `json:"target"`
+	Operation string `json:"operation"`
+	Status    int    `json:"status,omitempty"` // HTTP status of the failed call, when there was one
+	Error     string `json:"error"`
+}
+
+//
+// Returns an empty report for a run in the given mode that will be written to filename
+//
+func NewRunReport(runID string, runMode string, filename string) *RunReport {
+	return &RunReport{RunID: runID, Mode: strings.TrimPrefix(runMode, "--"), Started: time.Now(),
+		Targets: make(map[string]*TargetCounts), Failures: []UserFailure{}, filename: filename}
+}
+
+//
+// Count an operation outcome in the target
+//
+func (report *RunReport) count(target string, outcome string) {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	counts, ok := report.Targets[target]
+	if !ok {
+		counts = &TargetCounts{}
+		report.Targets[target] = counts
+	}
+	switch outcome {
+	case outcomeCreated:
+		counts.Created++
+	case outcomeUpdated:
+		counts.Updated++
+	case outcomeUnchanged:
+		counts.Unchanged++
+	case outcomeDeactivated:
+		counts.Deactivated++
+	case outcomeDeleted:
+		counts.Deleted++
+	case outcomeFailed:
+		counts.Failed++
+	case outcomePlanned:
+		counts.Planned++
+	}
+}
+
+//
+// Count a failed operation in the target and add it to the list of failures
+//
+func (report *RunReport) fail(target string, operation string, email string, err error) {
+	report.count(target, outcomeFailed)
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.Failures = append(report.Failures, UserFailure{User: email, Target: target, Operation: operation,
+		Status: httpStatus(err), Error: redactor.redact(err.Error())})
+}
+
+//
+// Returns the HTTP status an error was raised for, or 0 if it didn't come from an HTTP response
+//
+func httpStatus(err error) int {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Status
+	}
+	return 0
+}
+
+//
+// Write the report and exit with the given status
+//
+func (report *RunReport) exit(status int) {
+	report.write(status)
+	os.Exit(status)
+}
+
+//
+// Finish the report with the run's exit status and write it as indented JSON
+//
+func (report *RunReport) write(status int) {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.Finished = time.Now()
+	report.ExitStatus = status
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(report.filename, data, 0644)
+	}
+	if err != nil {
+		rootLog.Errorf("Error writing run report [%s]: %s", report.filename, err.Error())
+		return
+	}
+	rootLog.Infof("*** Run report written to %s", report.filename)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Operations recorded in the failure queue and the run report
+const (
+	operationSync       = "sync"
+	operationDelete     = "delete"
+	operationDeactivate = "deactivate"
+)
+
+//
+// Queue a failed operation for --retry-failed and add it to the run report, or remove it from the queue once it
+// succeeds.  Runs without a state store (plan mode) don't queue failures.
+//
+func trackOperation(ctx context.Context, session *Session, target Target, operation string, person AriaServicePerson, err error) {
+	if err != nil {
+		session.Report.fail(target.Name(), operation, person.UserID, err)
+	}
+	if session.State == nil {
+		return
+	}
+	if err == nil {
+		session.State.clearFailure(target.Name(), operation, person.UserID)
+		return
+	}
+
+	failure := session.State.recordFailure(target.Name(), operation, person, err)
+	if failure.Dead {
+		logFrom(ctx).Warnf("** %s of user in %s has failed %d times, moved to the dead list", failure.Operation,
+			failure.Target, failure.Attempts)
+	}
+}
+
+//
+// Replay only the operations in the failure queue that aren't dead.  Failures are retried a loop at a time in the
+// usual target order so targets that need preparation (OCE) are prepared first.  The person's current feed record
+// is used when they are still in the feed; a failed sync of someone who has since left the feed is dropped rather
+// than provisioning a leaver.
+//
+func runRetryFailed(ctx context.Context, session *Session, targets []Target, people []AriaServicePerson, workers int,
+	stop <-chan struct{}) {
+	feed := make(map[string]AriaServicePerson)
+	for _, person := range people {
+		feed[strings.ToLower(strings.TrimSpace(person.UserID))] = person
+	}
+
+	queued := session.State.failures()
+	phases := targetPhases(targets)
+phases:
+	for p, phase := range phases {
+		var retry []AriaServicePerson
+		byPerson := make(map[string][]FailedOperation)
+		for _, failure := range queued {
+			if failure.Dead || findTarget(phase, failure.Target) == nil {
+				continue
+			}
+			email := strings.ToLower(strings.TrimSpace(failure.Person.UserID))
+			person := failure.Person
+			if current, ok := feed[email]; ok {
+				current.Manager = convertManagerDnToEmail(current.Manager)
+				person = current
+			} else if failure.Operation == operationSync {
+				rootLog.Infof("*** Dropping failed sync of user [%s] in %s, they are no longer in the corporate identity feed", email,
+					failure.Target)
+				session.State.clearFailure(failure.Target, failure.Operation, email)
+				continue
+			}
+			if _, ok := byPerson[email]; !ok {
+				retry = append(retry, person)
+			}
+			byPerson[email] = append(byPerson[email], failure)
+		}
+		if len(retry) < 1 {
+			continue
+		}
+
+		for _, target := range phase {
+			if preparer, ok := target.(Preparer); ok {
+				log := rootLog.forTarget(target.Name())
+				log.Infof("*** Preparing %s in prep for next loop", target.Name())
+				if err := preparer.Prepare(withLogger(ctx, log)); err != nil {
+					log.Errorf("%s", err.Error())
+					log.Errorf("Can't prepare %s so no point in retrying %s.  Skipping....", target.Name(), target.Name())
+					continue phases
+				}
+			}
+		}
+
+		// a sync is replayed through a reconciler without an inventory so the person is looked up first and
+		// ownership is recorded just as it is by --add
+		reconciler := &Reconciler{targets: phase, session: session}
+		rootLog.Infof("*** Loop %d/%d:  Retry failed operations in %s using %d worker(s)", p+1, len(phases), targetNames(phase), workers)
+		counters := runWorkers(ctx, stop, retry, workers, peopleInFlight(phase, workers), func(ctx context.Context, person AriaServicePerson) error {
+			var failed error
+			for _, failure := range byPerson[strings.ToLower(strings.TrimSpace(person.UserID))] {
+				target := findTarget(phase, failure.Target)
+				ctx := withTarget(ctx, target.Name())
+				logFrom(ctx).Infof("** Retrying %s in %s, attempt %d", failure.Operation, target.Name(), failure.Attempts+1)
+				var err error
+				if failure.Operation == operationDelete {
+					var deleted bool
+					deleted, err = deletePersonFromTarget(ctx, session.State, target, person)
+					countDelete(session.Report, target, deleted, err)
+					trackOperation(ctx, session, target, operationDelete, person, err)
+				} else {
+					err = reconciler.apply(ctx, person, []pendingChange{{target: target}})
+				}
+				if err != nil {
+					if failed != nil {
+						logFrom(ctx).Errorf("%s", failed.Error())
+					}
+					failed = err
+				}
+			}
+			return failed
+		})
+		rootLog.Infof("*** Sucessfully retried [%d/%d] Users for %s, %d failed (%s)", counters.Succeeded(), len(retry),
+			targetNames(phase), counters.Failed(), time.Now().Format(time.RFC3339))
+		if interrupted(stop) {
+			return
+		}
+	}
+}
+
+//
+// Count the outcome of a delete in the run report.  Failures are counted by trackOperation.
+//
+func countDelete(report *RunReport, target Target, deleted bool, err error) {
+	if err == nil && deleted {
+		report.count(target.Name(), outcomeDeleted)
+	} else if err == nil {
+		report.count(target.Name(), outcomeUnchanged)
+	}
+}
+
+//
+// Print how many operations are waiting in the failure queue and every operation on the dead list
+//
+func printFailureSummary(state *StateStore) {
+	queued, dead := 0, 0
+	for _, failure := range state.failures() {
+		if !failure.Dead {
+			queued++
+			continue
+		}
+		dead++
+		rootLog.forTarget(failure.Target).Warnf("** DEAD: %s of user [%s] in %s failed %d times since %s: %s", failure.Operation, failure.Person.UserID,
+			failure.Target, failure.Attempts, failure.FirstFailed.Format(time.RFC3339), strings.SplitN(failure.Error, "\n", 2)[0])
+	}
+	rootLog.Infof("*** %d failed operations queued for --retry-failed, %d on the dead list", queued, dead)
+}
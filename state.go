@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultStateFile is used when StateFile isn't configured
+const defaultStateFile = "identity-state.json"
+
+// defaultRetryFailedMaxAttempts is how many times an operation may fail before it is moved to the dead list when
+// RetryFailedMaxAttempts isn't configured
+const defaultRetryFailedMaxAttempts = 5
+
+// StateStore is the local record this tool keeps between runs, persisted as a JSON file.  It is safe to use from
+// many goroutines.
+type StateStore struct {
+	Identities map[string]map[string]*OwnedIdentity `json:"identities"` // keyed by target name, then lowercase email
+	Leavers    map[string]*Leaver                   `json:"leavers"`    // keyed by lowercase email
+	Failures   map[string]*FailedOperation          `json:"failures"`   // keyed by target, operation and lowercase email
+
+	filename    string
+	maxAttempts int
+	mutex       sync.Mutex
+}
+
+// OwnedIdentity is a record in a target that this tool provisioned, or adopted because it matched a person in the
+// feed.  Clean and delete runs only touch owned identities.
+type OwnedIdentity struct {
+	RemoteID       string    `json:"remoteId"`
+	Created        bool      `json:"created"`                // created by this tool rather than adopted
+	Entitlements   []string  `json:"entitlements,omitempty"` // e.g. IDCS groups or VBCS role granted by this tool
+	AttributesHash string    `json:"attributesHash"`         // hash of the feed record last applied
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// FailedOperation is a sync or delete of a person in a target that failed and is queued for --retry-failed.  Once
+// it has failed RetryFailedMaxAttempts times it is dead and is no longer retried.
+type FailedOperation struct {
+	Person      AriaServicePerson `json:"person"` // as last processed, with the manager DN converted
+	Target      string            `json:"target"`
+	Operation   string            `json:"operation"`
+	Error       string            `json:"error"`
+	Attempts    int               `json:"attempts"`
+	FirstFailed time.Time         `json:"firstFailed"`
+	LastFailed  time.Time         `json:"lastFailed"`
+	Dead        bool              `json:"dead"`
+}
+
+// Leaver is a user who has disappeared from the corporate identity feed and has been deactivated but not yet deleted
+type Leaver struct {
+	DeactivatedAt time.Time `json:"deactivatedAt"`
+}
+
+//
+// Load the state file named in the config.  A missing file is an empty state, which is expected on the first run.
+//
+func LoadStateStore(config Config) (*StateStore, error) {
+	filename := config.StateFile
+	if len(filename) < 1 {
+		filename = defaultStateFile
+	}
+	store := &StateStore{filename: filename, maxAttempts: config.RetryFailedMaxAttempts}
+	if store.maxAttempts < 1 {
+		store.maxAttempts = defaultRetryFailedMaxAttempts
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, store); err != nil {
+			return nil, err
+		}
+	}
+	if store.Identities == nil {
+		store.Identities = make(map[string]map[string]*OwnedIdentity)
+	}
+	if store.Leavers == nil {
+		store.Leavers = make(map[string]*Leaver)
+	}
+	if store.Failures == nil {
+		store.Failures = make(map[string]*FailedOperation)
+	}
+	return store, nil
+}
+
+//
+// Record that the identity was written, or found already in sync, by this run.  An identity that was found in sync
+// and is already owned is left as it is.
+//
+func (store *StateStore) recordIdentity(target string, email string, identity OwnedIdentity, written bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	owned, ok := store.Identities[target]
+	if !ok {
+		owned = make(map[string]*OwnedIdentity)
+		store.Identities[target] = owned
+	}
+	existing, ok := owned[email]
+	if ok && !written {
+		return
+	}
+
+	now := time.Now()
+	identity.CreatedAt, identity.UpdatedAt = now, now
+	if ok {
+		identity.CreatedAt = existing.CreatedAt
+		identity.Created = identity.Created || existing.Created
+		if len(identity.RemoteID) < 1 {
+			identity.RemoteID = existing.RemoteID
+		}
+	}
+	owned[email] = &identity
+}
+
+//
+// Reports whether the target's identity for the email is owned by this tool
+//
+func (store *StateStore) owns(target string, email string) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	_, ok := store.Identities[target][email]
+	return ok
+}
+
+//
+// Returns the lowercase emails of every identity the tool owns in the target, in order
+//
+func (store *StateStore) ownedEmails(target string) []string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var emails []string
+	for email := range store.Identities[target] {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	return emails
+}
+
+//
+// Forget an identity that was deleted from its target
+//
+func (store *StateStore) forgetIdentity(target string, email string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.Identities[target], email)
+}
+
+//
+// Forget the target's identities that aren't in the given set of lowercase emails, because they were deleted outside
+// of this tool
+//
+func (store *StateStore) pruneIdentities(target string, keep map[string]bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for email := range store.Identities[target] {
+		if !keep[email] {
+			delete(store.Identities[target], email)
+		}
+	}
+}
+
+//
+// Queue a failed operation, or count another attempt if it is already queued.  Returns a copy of the queued
+// operation, which is dead once it has failed too many times.
+//
+func (store *StateStore) recordFailure(target string, operation string, person AriaServicePerson, err error) FailedOperation {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key := failureKey(target, operation, person.UserID)
+	failure, ok := store.Failures[key]
+	if !ok {
+		failure = &FailedOperation{Target: target, Operation: operation, FirstFailed: time.Now()}
+		store.Failures[key] = failure
+	}
+	failure.Person = person
+	failure.Error = redactor.redact(err.Error())
+	failure.Attempts++
+	failure.LastFailed = time.Now()
+	failure.Dead = failure.Attempts >= store.maxAttempts
+	return *failure
+}
+
+//
+// Remove an operation from the failure queue, including the dead list, once it has succeeded
+//
+func (store *StateStore) clearFailure(target string, operation string, email string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.Failures, failureKey(target, operation, email))
+}
+
+//
+// Returns a copy of every queued operation, oldest failure first
+//
+func (store *StateStore) failures() []FailedOperation {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var failures []FailedOperation
+	for _, failure := range store.Failures {
+		failures = append(failures, *failure)
+	}
+	sort.Slice(failures, func(i, j int) bool { return failures[i].FirstFailed.Before(failures[j].FirstFailed) })
+	return failures
+}
+
+//
+// Returns the key of an operation in the failure queue
+//
+func failureKey(target string, operation string, email string) string {
+	return target + "|" + operation + "|" + strings.ToLower(strings.TrimSpace(email))
+}
+
+//
+// Returns a hash of the person's feed record so the state shows whether the last applied data is still current
+//
+func attributesHash(person AriaServicePerson) string {
+	data, _ := json.Marshal(person)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+//
+// Returns when the user was deactivated, recording now as their deactivation date if they weren't a leaver yet
+//
+func (store *StateStore) markLeaver(email string) time.Time {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	leaver, ok := store.Leavers[email]
+	if !ok {
+		leaver = &Leaver{DeactivatedAt: time.Now()}
+		store.Leavers[email] = leaver
+	}
+	return leaver.DeactivatedAt
+}
+
+//
+// Returns the user's leaver record or nil if they aren't a leaver
+//
+func (store *StateStore) leaver(email string) *Leaver {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.Leavers[email]
+}
+
+//
+// Forget a leaver, either because they came back or because they have been deleted everywhere
+//
+func (store *StateStore) removeLeaver(email string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.Leavers, email)
+}
+
+//
+// Forget every leaver who isn't in the given set of lowercase emails
+//
+func (store *StateStore) pruneLeavers(keep map[string]bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for email := range store.Leavers {
+		if !keep[email] {
+			delete(store.Leavers, email)
+		}
+	}
+}
+
+//
+// Write the state to a temporary file and rename it over the state file so a crash never leaves a partial file
+//
+func (store *StateStore) Save() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(store.filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(store.filename+".tmp", store.filename)
+}
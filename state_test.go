@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateStoreFailures(t *testing.T) {
+	config := Config{StateFile: filepath.Join(t.TempDir(), "state.json"), RetryFailedMaxAttempts: 3}
+	state, err := LoadStateStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	person := AriaServicePerson{UserID: "a@oracle.com"}
+
+	// every attempt is counted against the same operation and the last allowed attempt makes it dead
+	for attempt := 1; attempt <= 3; attempt++ {
+		failure := state.recordFailure("ECAL", operationSync, person, errors.New("ERROR: failed"))
+		if failure.Attempts != attempt || failure.Dead != (attempt == 3) {
+			t.Errorf("attempt %d: attempts = %d, dead = %t", attempt, failure.Attempts, failure.Dead)
+		}
+	}
+	state.recordFailure("IDCS", operationSync, person, errors.New("ERROR: failed"))
+	if failures := state.failures(); len(failures) != 2 {
+		t.Fatalf("failures() = %v, want ECAL and IDCS", failures)
+	}
+
+	// the dead operation survives a reload and is cleared by a success whatever the case of the email
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+	state, err = LoadStateStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, failure := range state.failures() {
+		if failure.Target == "ECAL" && (!failure.Dead || failure.Attempts != 3) {
+			t.Errorf("reloaded ECAL failure: attempts = %d, dead = %t", failure.Attempts, failure.Dead)
+		}
+	}
+	state.clearFailure("ECAL", operationSync, " A@Oracle.com ")
+	failures := state.failures()
+	if len(failures) != 1 || failures[0].Target != "IDCS" {
+		t.Errorf("after clearing ECAL failures() = %v, want IDCS only", failures)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Session holds the state shared by every target during a single invocation.  It is shared by all workers.
+type Session struct {
+	Config       Config
+	Client       *http.Client
+	Plan         *Plan
+	IDCSToken    *TokenSource
+	OCEToken     *TokenSource
+	EnsureGroups bool        // create managed IDCS groups that don't exist yet
+	State        *StateStore // local state kept between runs, only loaded by runs that need it
+	Report       *RunReport  // outcome of this run, written when it exits
+}
+
+// RemoteIdentity is a single user record as it exists in a target system
+type RemoteIdentity struct {
+	ID    string       // target specific unique id used for updates and deletes
+	Email string       // email address the record is keyed on
+	Data  gjson.Result // raw record as returned by the target
+}
+
+// errAlreadyExists is returned by Create when the target already holds the person, which happens when someone else
+// created them after they were looked up
+var errAlreadyExists = errors.New("user already exists")
+
+// Target is a system that users from the corporate identity feed are provisioned into
+type Target interface {
+	// Name is the short name used in output and plans (IDCS, ECAL, OCE, ...)
+	Name() string
+
+	// Applies reports whether the person should be provisioned in this target during an add
+	Applies(person AriaServicePerson) bool
+
+	// Lookup returns the person's record in the target or nil if they don't exist there
+	Lookup(ctx context.Context, person AriaServicePerson) (*RemoteIdentity, error)
+
+	// Create provisions a person who was not found by Lookup, returning errAlreadyExists if they were created since.
+	// The created record is returned along with the error when a step after the create fails.
+	Create(ctx context.Context, person AriaServicePerson) (*RemoteIdentity, error)
+
+	// Update brings an existing record in line with the person's data from the feed and reports whether anything
+	// was written (or, in plan mode, planned)
+	Update(ctx context.Context, person AriaServicePerson, existing *RemoteIdentity) (bool, error)
+
+	// Delete removes an existing record from the target
+	Delete(ctx context.Context, person AriaServicePerson, existing *RemoteIdentity) error
+
+	// List returns every identity the target currently holds for the managed user population
+	List(ctx context.Context) ([]RemoteIdentity, error)
+}
+
+// Deactivator is implemented by targets that can disable a record without deleting it, so a leaver can be kept
+// for a grace period and brought back intact if they return to the feed
+type Deactivator interface {
+	Deactivate(ctx context.Context, person AriaServicePerson, existing *RemoteIdentity) error
+}
+
+// Entitler is implemented by targets that grant a person entitlements beyond the record itself, so they can be
+// recorded in the state store along with the identity
+type Entitler interface {
+	Entitlements(person AriaServicePerson) []string
+}
+
+// Batcher is implemented by targets that can group their writes into batched requests, so a loop over them keeps
+// enough people in flight to fill a batch whatever the number of workers
+type Batcher interface {
+	BatchSize() int
+}
+
+// Initializer is implemented by targets that resolve their configuration against the target system once at
+// startup, before any user is processed.  An error stops the run.
+type Initializer interface {
+	Initialize(ctx context.Context) error
+}
+
+// Preparer is implemented by targets that need a one-time step after all other targets have been processed
+// and before their own per-user loop can run (e.g. OCE must sync profile data from IDCS first)
+type Preparer interface {
+	Prepare(ctx context.Context) error
+}
+
+// targetFactory builds the targets of one kind from configuration.  A factory returns no targets when its
+// kind isn't configured and an error when its configuration is invalid.
+type targetFactory func(session *Session) ([]Target, error)
+
+// targetFactories lists every registered target kind in the order targets are processed
+var targetFactories = []struct {
+	kind    string
+	factory targetFactory
+}{
+	{"IDCS", newIDCSTargets},
+	{"VBCS", newVBCSTargets},
+	{"OCE", newOCETargets},
+}
+
+//
+// Build the list of targets enabled for this run.  If the EnabledTargets config value is set then only targets
+// whose names appear in that comma-separated list are returned, otherwise every configured target is returned.
+// Returns an error when the configuration of any target is invalid.
+//
+func enabledTargets(session *Session) ([]Target, error) {
+	enabled := make(map[string]bool)
+	for _, name := range strings.Split(session.Config.EnabledTargets, ",") {
+		if len(strings.TrimSpace(name)) > 0 {
+			enabled[strings.ToUpper(strings.TrimSpace(name))] = true
+		}
+	}
+
+	var targets []Target
+	for _, registration := range targetFactories {
+		built, err := registration.factory(session)
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range built {
+			if len(enabled) == 0 || enabled[strings.ToUpper(target.Name())] {
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets, nil
+}
+
+//
+// Split targets into processing phases.  The first phase holds all targets that can be processed directly and
+// each Preparer gets its own later phase so it can be prepared once the earlier phases are complete.
+//
+func targetPhases(targets []Target) [][]Target {
+	var direct []Target
+	var deferred [][]Target
+	for _, target := range targets {
+		if _, ok := target.(Preparer); ok {
+			deferred = append(deferred, []Target{target})
+		} else {
+			direct = append(direct, target)
+		}
+	}
+
+	var phases [][]Target
+	if len(direct) > 0 {
+		phases = append(phases, direct)
+	}
+	return append(phases, deferred...)
+}
+
+//
+// Returns how many people a loop over the targets keeps in flight: the number of workers, or the largest batch size
+// of the targets if that is larger
+//
+func peopleInFlight(targets []Target, workers int) int {
+	inFlight := workers
+	for _, target := range targets {
+		if batcher, ok := target.(Batcher); ok && batcher.BatchSize() > inFlight {
+			inFlight = batcher.BatchSize()
+		}
+	}
+	return inFlight
+}
+
+//
+// Returns the names of the given targets as a comma-separated string for output
+//
+func targetNames(targets []Target) string {
+	var names []string
+	for _, target := range targets {
+		names = append(names, target.Name())
+	}
+	return strings.Join(names, ", ")
+}
+
+//
+// Returns the enabled target with the given name or nil if it isn't enabled
+//
+func findTarget(targets []Target, name string) Target {
+	for _, target := range targets {
+		if strings.EqualFold(target.Name(), name) {
+			return target
+		}
+	}
+	return nil
+}
+
+//
+// Create a person in a target.  When the target reports that the person was created by someone else since they
+// were looked up, their record is looked up again and adopted by updating it like any existing record.  Returns
+// the person's record and whether this call created it, which can be alongside an error when the record was
+// created but a later step such as a group add failed.
+//
+func createOrAdopt(ctx context.Context, target Target, person AriaServicePerson) (*RemoteIdentity, bool, error) {
+	identity, err := target.Create(ctx, person)
+	if err != errAlreadyExists {
+		return identity, identity != nil, err
+	}
+
+	logFrom(ctx).Infof("** User already exists in %s, adopting their record", target.Name())
+	existing, err := target.Lookup(ctx, person)
+	if err != nil {
+		return nil, false, err
+	}
+	if existing == nil {
+		return nil, false, fmt.Errorf("ERROR: %s reported user [%s] already exists but they can't be found", target.Name(),
+			person.UserID)
+	}
+	_, err = target.Update(ctx, person, existing)
+	return existing, false, err
+}
+
+//
+// Remove a single person from a single target.  A person who isn't found in the target is not an error, and a
+// record this tool doesn't own is left alone.  Returns whether the person was deleted.
+//
+func deletePersonFromTarget(ctx context.Context, state *StateStore, target Target, person AriaServicePerson) (bool, error) {
+	existing, err := target.Lookup(ctx, person)
+	if err != nil {
+		return false, err
+	}
+
+	email := strings.ToLower(strings.TrimSpace(person.UserID))
+	if existing == nil {
+		logFrom(ctx).Infof("** User [%s] not found in %s, nothing to remove", person.UserID, target.Name())
+		return false, nil
+	}
+	if !state.owns(target.Name(), email) {
+		logFrom(ctx).Infof("** User [%s] in %s wasn't provisioned by this tool, leaving it alone", person.UserID, target.Name())
+		return false, nil
+	}
+	if err := target.Delete(ctx, person, existing); err != nil {
+		return false, err
+	}
+	state.forgetIdentity(target.Name(), email)
+	return true, nil
+}
+
+//
+// Initialize every target that needs it.  Returns the first error so the run can stop before any user is touched.
+//
+func initializeTargets(ctx context.Context, targets []Target) error {
+	for _, target := range targets {
+		if initializer, ok := target.(Initializer); ok {
+			if err := initializer.Initialize(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,709 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// defaultRemoveUserFromGroupPayload is used when IdcsRemoveUserFromGroupPayload isn't configured
+const defaultRemoveUserFromGroupPayload = `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"remove","path":"members[value eq \"%USERID%\"]"}]}`
+
+// setActivePayload is the SCIM PatchOp that deactivates or reactivates a user, with %ACTIVE% set to false or true
+const setActivePayload = `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"active","value":%ACTIVE%}]}`
+
+// defaultCreateGroupPayload is used when IdcsCreateGroupPayload isn't configured
+const defaultCreateGroupPayload = `{"schemas":["urn:ietf:params:scim:schemas:core:2.0:Group","urn:ietf:params:scim:schemas:oracle:idcs:extension:group:Group"],"displayName":"%GROUPNAME%","urn:ietf:params:scim:schemas:oracle:idcs:extension:group:Group":{"description":"%DESCRIPTION%"}}`
+
+// defaultGroupDescription is used when IdcsGroupDescription isn't configured
+const defaultGroupDescription = "Managed by cto-identity-sync"
+
+// defaultUserAttributes are the IDCS user attributes always compared with the feed, keyed by attribute path with
+// the payload placeholder that holds the expected value
+var defaultUserAttributes = map[string]string{
+	"name.givenName":  "%FIRSTNAME%",
+	"name.familyName": "%LASTNAME%",
+}
+
+// idcsTarget provisions users into IDCS and maps them to the configured user or manager groups
+type idcsTarget struct {
+	session *Session
+	http    *HTTPClient
+	bulk    *BulkWriter // nil unless IdcsBulkBatchSize is set
+
+	// IDs of the managed groups keyed by name, resolved once by Initialize and only read after that
+	groupIDs map[string]string
+}
+
+//
+// IDCS is enabled whenever an IDCS base URL is configured
+//
+func newIDCSTargets(session *Session) ([]Target, error) {
+	if len(session.Config.IdcsBaseURL) < 1 {
+		return nil, nil
+	}
+	target := &idcsTarget{session: session, http: NewHTTPClient(session.Config, session.Client, "IDCS")}
+	if session.Config.IdcsBulkBatchSize > 0 {
+		target.bulk = NewBulkWriter(session.Config, target.http, target.authorize)
+	}
+	return []Target{target}, nil
+}
+
+func (t *idcsTarget) Name() string {
+	return "IDCS"
+}
+
+//
+// Batches hold up to IdcsBulkBatchSize operations when bulk requests are enabled
+//
+func (t *idcsTarget) BatchSize() int {
+	if t.bulk == nil {
+		return 0
+	}
+	return t.session.Config.IdcsBulkBatchSize
+}
+
+func (t *idcsTarget) Applies(person AriaServicePerson) bool {
+	return true
+}
+
+//
+// Resolve the name of every managed group to its IDCS ID once so workers never have to look groups up.  Missing
+// groups are created when the run was started with --ensure-groups, otherwise every missing group is reported in a
+// single error.
+//
+func (t *idcsTarget) Initialize(ctx context.Context) error {
+	t.groupIDs = make(map[string]string)
+	var missing []string
+	for _, groupName := range managedGroupNames(t.session.Config) {
+		groupID, err := t.lookupGroupID(ctx, groupName)
+		if err != nil {
+			return err
+		}
+		if len(groupID) < 1 && t.session.EnsureGroups {
+			groupID, err = t.createGroup(ctx, groupName)
+			if err != nil {
+				return err
+			}
+		}
+		if len(groupID) < 1 {
+			missing = append(missing, groupName)
+			continue
+		}
+		t.groupIDs[groupName] = groupID
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("ERROR: Configured IDCS groups not found in IDCS: [%s].  Run with --ensure-groups to create them.",
+			strings.Join(missing, ", "))
+	}
+	logFrom(ctx).Infof("*** Resolved %d managed IDCS groups", len(t.groupIDs))
+	return nil
+}
+
+//
+// Look up the user in IDCS by userName (which is their email address)
+//
+func (t *idcsTarget) Lookup(ctx context.Context, person AriaServicePerson) (*RemoteIdentity, error) {
+	queryString := url.QueryEscape("userName eq \"" + strings.TrimSpace(person.UserID) + "\"")
+	result, err := singleSCIMResource(ctx, t.http, t.session.Config.IdcsBaseURL+"/admin/v1/Users?filter="+queryString,
+		t.authorize, "Getting User ID from IDCS")
+	if err != nil || result == nil {
+		return nil, err
+	}
+	return &RemoteIdentity{ID: result.Get("id").String(), Email: result.Get("userName").String(), Data: *result}, nil
+}
+
+//
+// Add the user to IDCS and then add them to the correct IDCS groups based on whether they are an employee
+// or a manager.  Returns errAlreadyExists when IDCS answers 409 because the user was created since the lookup.
+//
+func (t *idcsTarget) Create(ctx context.Context, person AriaServicePerson) (*RemoteIdentity, error) {
+	config := t.session.Config
+	payload := renderIDCSPayload(config.IdcsCreateNewUserPayload, person)
+
+	identity := &RemoteIdentity{ID: plannedUserID, Email: person.UserID}
+	if t.session.Plan != nil {
+		t.session.Plan.add(ctx, person, t.Name(), PlanCreate, payload)
+	} else if t.bulk != nil {
+		result, err := t.bulk.Submit(ctx, "POST", "/Users", payload)
+		if err != nil {
+			return nil, err
+		}
+		// 409 is expected if someone else created the user since the lookup, the caller adopts their record
+		if result.status == 409 {
+			return nil, errAlreadyExists
+		}
+		if result.status != 201 {
+			return nil, result.failure("Adding user to IDCS")
+		}
+		id := result.createdID()
+		if len(id) < 1 {
+			return nil, &HTTPError{Status: result.status, Message: fmt.Sprintf(
+				"ERROR: Adding user to IDCS: bulk operation returned %d without an id or location", result.status)}
+		}
+		identity = &RemoteIdentity{ID: id, Email: person.UserID, Data: result.response}
+	} else {
+		req, _ := http.NewRequestWithContext(ctx, "POST", config.IdcsBaseURL+"/admin/v1/Users", strings.NewReader(payload))
+		if err := t.authorize(req); err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Content-Length", strconv.Itoa(len(payload)))
+		res, err := t.http.Do(req)
+		if err == nil && res != nil && res.StatusCode == 409 {
+			// someone else created the user since the lookup, the caller adopts their record
+			res.Body.Close()
+			return nil, errAlreadyExists
+		}
+		if err != nil || res == nil || res.StatusCode != 201 {
+			return nil, httpError("Adding user to IDCS", err, res)
+		}
+		defer res.Body.Close()
+
+		json, _ := ioutil.ReadAll(res.Body)
+		result := gjson.Parse(string(json))
+		identity = &RemoteIdentity{ID: result.Get("id").String(), Email: person.UserID, Data: result}
+	}
+
+	_, err := t.reconcileGroups(ctx, person, identity.ID, make(map[string]bool))
+	return identity, err
+}
+
+//
+// Existing users have their name and any configured extra attributes brought in line with the feed, and their group
+// membership reconciled every run so role changes and missing mappings get repaired.  A leaver who was deactivated
+// and has come back to the feed is reactivated.  Returns whether anything was written.
+//
+func (t *idcsTarget) Update(ctx context.Context, person AriaServicePerson, existing *RemoteIdentity) (bool, error) {
+	reactivated := false
+	if existing.Data.Get("active").Exists() && !existing.Data.Get("active").Bool() {
+		logFrom(ctx).Infof("** User is back in the corporate identity feed, reactivating in IDCS")
+		if err := t.setActive(ctx, person, existing, true); err != nil {
+			return false, err
+		}
+		reactivated = true
+	}
+	updated, err := t.updateAttributes(ctx, person, existing)
+	if err != nil {
+		return reactivated, err
+	}
+
+	current, err := t.currentGroupIDs(ctx, existing)
+	if err != nil {
+		return reactivated || updated, err
+	}
+	regrouped, err := t.reconcileGroups(ctx, person, existing.ID, current)
+	return reactivated || updated || regrouped, err
+}
+
+//
+// An inventoried user needs an update when they were deactivated, when one of their compared attributes differs
+// from the feed, when they are missing one of their expected groups or when they are still in a managed group they
+// no longer belong in
+//
+func (t *idcsTarget) NeedsUpdate(person AriaServicePerson, existing *RemoteIdentity) bool {
+	if existing.Data.Get("active").Exists() && !existing.Data.Get("active").Bool() {
+		return true
+	}
+	if len(t.changedAttributes(person, existing)) > 0 || !existing.Data.Get("groups").Exists() {
+		return true
+	}
+	// groups are compared by the IDs resolved at startup, as reconcileGroups does, since IDCS matches group names
+	// without regard to case
+	current := make(map[string]bool)
+	for _, id := range existing.Data.Get("groups.#.value").Array() {
+		current[id.String()] = true
+	}
+
+	expected := make(map[string]bool)
+	for _, groupName := range expectedGroupNames(t.session.Config, person) {
+		groupID := t.groupIDs[groupName]
+		if !current[groupID] {
+			return true
+		}
+		expected[groupID] = true
+	}
+	for _, groupName := range managedGroupNames(t.session.Config) {
+		groupID := t.groupIDs[groupName]
+		if current[groupID] && !expected[groupID] {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// The groups a person is granted are their expected managed groups
+//
+func (t *idcsTarget) Entitlements(person AriaServicePerson) []string {
+	return expectedGroupNames(t.session.Config, person)
+}
+
+//
+// Delete the user from IDCS and set the force flag since we want to automatically remove the user's group associations
+//
+func (t *idcsTarget) Delete(ctx context.Context, person AriaServicePerson, existing *RemoteIdentity) error {
+	req, _ := http.NewRequestWithContext(ctx, "DELETE", t.session.Config.IdcsBaseURL+"/admin/v1/Users/"+existing.ID+"?forceDelete=true", nil)
+	if err := t.authorize(req); err != nil {
+		return err
+	}
+	res, err := t.http.Do(req)
+	if err != nil || res == nil || (res.StatusCode != 200 && res.StatusCode != 204) {
+		return httpError("Deleting user from IDCS", err, res)
+	}
+	defer res.Body.Close()
+	return nil
+}
+
+//
+// Deactivate a leaver in IDCS, keeping their account and group memberships until they are deleted
+//
+func (t *idcsTarget) Deactivate(ctx context.Context, person AriaServicePerson, existing *RemoteIdentity) error {
+	return t.setActive(ctx, person, existing, false)
+}
+
+//
+// Set the user's active flag
+//
+func (t *idcsTarget) setActive(ctx context.Context, person AriaServicePerson, existing *RemoteIdentity, active bool) error {
+	if t.session.Plan != nil {
+		t.session.Plan.add(ctx, person, t.Name(), PlanUpdate, "active: "+strconv.FormatBool(active))
+		return nil
+	}
+
+	payload := strings.ReplaceAll(setActivePayload, "%ACTIVE%", strconv.FormatBool(active))
+	req, _ := http.NewRequestWithContext(ctx, "PATCH", t.session.Config.IdcsBaseURL+"/admin/v1/Users/"+existing.ID, strings.NewReader(payload))
+	if err := t.authorize(req); err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Length", strconv.Itoa(len(payload)))
+	res, err := t.http.DoIdempotent(req)
+	if err != nil || res == nil || res.StatusCode != 200 {
+		return httpError("Setting IDCS user active to "+strconv.FormatBool(active), err, res)
+	}
+	defer res.Body.Close()
+	return nil
+}
+
+//
+// The IDCS users this tool manages are the members of the groups named by the group rules.  Members are listed
+// through a paged users query rather than the group's members attribute so large groups are read in full, and
+// each user's groups and compared attributes are read along with them so they can be diffed without another call.
+//
+func (t *idcsTarget) List(ctx context.Context) ([]RemoteIdentity, error) {
+	seen := make(map[string]bool)
+	var identities []RemoteIdentity
+	for _, groupName := range managedGroupNames(t.session.Config) {
+		groupID, err := t.groupID(groupName)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(groupID, plannedGroupID) {
+			continue // a group this plan would create has no members yet
+		}
+
+		queryString := url.QueryEscape("groups.value eq \"" + groupID + "\"")
+		err = eachSCIMResource(ctx, t.http, t.session.Config.IdcsBaseURL+"/admin/v1/Users?attributes="+t.listAttributes()+"&filter="+queryString,
+			t.authorize, "Getting group members from IDCS", func(user gjson.Result) error {
+				id := user.Get("id").String()
+				if !seen[id] {
+					seen[id] = true
+					identities = append(identities, RemoteIdentity{ID: id, Email: user.Get("userName").String(), Data: user})
+				}
+				return nil
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return identities, nil
+}
+
+//
+// Send a SCIM PATCH rendered from the update payload template when any compared attribute differs from the feed.
+// Returns whether the PATCH was sent.
+//
+func (t *idcsTarget) updateAttributes(ctx context.Context, person AriaServicePerson, existing *RemoteIdentity) (bool, error) {
+	changes := t.changedAttributes(person, existing)
+	if len(changes) < 1 {
+		return false, nil
+	}
+	for _, change := range changes {
+		logFrom(ctx).Infof("** IDCS %s", change)
+	}
+	payload := t.defaultUpdatePayload(person)
+	if len(t.session.Config.IdcsUpdateUserPayload) > 0 {
+		payload = renderIDCSPayload(t.session.Config.IdcsUpdateUserPayload, person)
+	}
+	if t.session.Plan != nil {
+		t.session.Plan.add(ctx, person, t.Name(), PlanUpdate, strings.Join(changes, "; "))
+		return true, nil
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "PATCH", t.session.Config.IdcsBaseURL+"/admin/v1/Users/"+existing.ID, strings.NewReader(payload))
+	if err := t.authorize(req); err != nil {
+		return false, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Length", strconv.Itoa(len(payload)))
+	res, err := t.http.DoIdempotent(req)
+	if err != nil || res == nil || res.StatusCode != 200 {
+		return false, httpError("Updating user attributes in IDCS", err, res)
+	}
+	defer res.Body.Close()
+	return true, nil
+}
+
+//
+// Compares the user's name and the extra attributes in IdcsUserAttributes with the feed and describes each
+// attribute whose value differs as "attribute: old -> new"
+//
+func (t *idcsTarget) changedAttributes(person AriaServicePerson, existing *RemoteIdentity) []string {
+	attributes := t.userAttributes()
+	var changes []string
+	for _, path := range attributePaths(attributes) {
+		current := scimAttribute(existing.Data, path).String()
+		expected := renderIDCSPayload(attributes[path], person)
+		if current != expected {
+			changes = append(changes, fmt.Sprintf("%s: %q -> %q", path, current, expected))
+		}
+	}
+	return changes
+}
+
+//
+// Renders the PatchOp sent when IdcsUpdateUserPayload isn't configured.  It replaces every attribute compared with
+// the feed so users converge whatever extra IdcsUserAttributes are configured.
+//
+func (t *idcsTarget) defaultUpdatePayload(person AriaServicePerson) string {
+	type operation struct {
+		Op    string `json:"op"`
+		Path  string `json:"path"`
+		Value string `json:"value"`
+	}
+	patch := struct {
+		Schemas    []string    `json:"schemas"`
+		Operations []operation `json:"Operations"`
+	}{Schemas: []string{"urn:ietf:params:scim:api:messages:2.0:PatchOp"}}
+
+	attributes := t.userAttributes()
+	for _, path := range attributePaths(attributes) {
+		patch.Operations = append(patch.Operations, operation{Op: "replace", Path: path,
+			Value: renderIDCSPayload(attributes[path], person)})
+	}
+	data, _ := json.Marshal(patch)
+	return string(data)
+}
+
+//
+// Returns the attribute paths in a stable order
+//
+func attributePaths(attributes map[string]string) []string {
+	var paths []string
+	for path := range attributes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+//
+// Returns the attributes compared with the feed, which are the user's name plus anything in IdcsUserAttributes
+//
+func (t *idcsTarget) userAttributes() map[string]string {
+	attributes := make(map[string]string)
+	for path, template := range defaultUserAttributes {
+		attributes[path] = template
+	}
+	for path, template := range t.session.Config.IdcsUserAttributes {
+		attributes[path] = template
+	}
+	return attributes
+}
+
+//
+// Returns the SCIM attributes requested when listing users: everything needed to diff them against the feed
+//
+func (t *idcsTarget) listAttributes() string {
+	attributes := []string{"userName", "active", "groups"}
+	for path := range t.userAttributes() {
+		attributes = append(attributes, path)
+	}
+	return url.QueryEscape(strings.Join(attributes, ","))
+}
+
+//
+// Reconciles the user's membership of the managed IDCS groups.  A person belongs in the groups of every group rule
+// they match, so someone whose role, LOB or manager chain changed is added to the groups they are missing and removed
+// from the managed groups they should no longer be in.  Groups that aren't named by any rule are never touched.
+// current holds the IDs of the groups the user is in now, which is empty for a user who was just created.  Returns
+// whether any membership was changed.
+//
+func (t *idcsTarget) reconcileGroups(ctx context.Context, person AriaServicePerson, UserID string, current map[string]bool) (bool, error) {
+	plan := t.session.Plan
+
+	// resolve the names of the groups this person should be in and of every group this tool manages
+	expectedNames := expectedGroupNames(t.session.Config, person)
+	expected := make(map[string]bool)
+	groupIDs := make(map[string]string)
+	for _, groupName := range expectedNames {
+		groupID, err := t.groupID(groupName)
+		if err != nil {
+			return false, err
+		}
+		groupIDs[groupName] = groupID
+		expected[groupID] = true
+	}
+	var managedNames []string
+	for _, groupName := range managedGroupNames(t.session.Config) {
+		if len(groupIDs[groupName]) > 0 {
+			continue
+		}
+		groupID, err := t.groupID(groupName)
+		if err != nil {
+			return false, err
+		}
+		groupIDs[groupName] = groupID
+		managedNames = append(managedNames, groupName)
+	}
+
+	// add the user to the expected groups they are missing
+	changed := false
+	for _, groupName := range expectedNames {
+		groupID := groupIDs[groupName]
+		if current[groupID] {
+			continue
+		}
+		changed = true
+		if plan != nil {
+			plan.add(ctx, person, t.Name(), PlanGroupAdd, groupName)
+			continue
+		}
+		err := t.patchGroup(ctx, groupID, t.session.Config.IdcsAddUserToGroupPayload, UserID,
+			"Adding user to IDCS group ["+groupName+"]")
+		if err != nil {
+			return changed, err
+		}
+	}
+
+	// remove the user from the managed groups they are no longer expected to be in
+	for _, groupName := range managedNames {
+		groupID := groupIDs[groupName]
+		if !current[groupID] || expected[groupID] {
+			continue
+		}
+		changed = true
+		if plan != nil {
+			plan.add(ctx, person, t.Name(), PlanGroupRemove, groupName)
+			continue
+		}
+		logFrom(ctx).Infof("** Removing user from IDCS group [%s] they no longer belong in", groupName)
+		err := t.patchGroup(ctx, groupID, t.removeFromGroupPayload(), UserID, "Removing user from IDCS group ["+groupName+"]")
+		if err != nil {
+			return changed, err
+		}
+	}
+
+	return changed, nil
+}
+
+//
+// Returns the SCIM PatchOp payload used to remove a member from a group
+//
+func (t *idcsTarget) removeFromGroupPayload() string {
+	if len(t.session.Config.IdcsRemoveUserFromGroupPayload) > 0 {
+		return t.session.Config.IdcsRemoveUserFromGroupPayload
+	}
+	return defaultRemoveUserFromGroupPayload
+}
+
+//
+// Send a membership PATCH to a group, as part of a bulk request when batching is enabled.  Membership changes are
+// safe to repeat so they are retried like any other idempotent request.
+//
+func (t *idcsTarget) patchGroup(ctx context.Context, groupID string, template string, UserID string, action string) error {
+	payload := strings.ReplaceAll(template, "%USERID%", UserID)
+	if t.bulk != nil {
+		result, err := t.bulk.Submit(ctx, "PATCH", "/Groups/"+groupID, payload)
+		if err != nil {
+			return err
+		}
+		if result.status != 200 && result.status != 204 {
+			return result.failure(action)
+		}
+		return nil
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "PATCH",
+		t.session.Config.IdcsBaseURL+"/admin/v1/Groups/"+groupID, strings.NewReader(payload))
+	if err := t.authorize(req); err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Length", strconv.Itoa(len(payload)))
+	res, err := t.http.DoIdempotent(req)
+	if err != nil || res == nil || (res.StatusCode != 200 && res.StatusCode != 204) {
+		return httpError(action, err, res)
+	}
+	res.Body.Close()
+	return nil
+}
+
+//
+// Add the IDCS bearer token to a request
+//
+func (t *idcsTarget) authorize(req *http.Request) error {
+	accessToken, err := t.session.IDCSToken.Token(req.Context())
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	return nil
+}
+
+//
+// Create a group from the IdcsCreateGroupPayload template and return its ID.  In plan mode the create is held back
+// and a placeholder ID is returned so the plan can still show who would be added to the group.
+//
+func (t *idcsTarget) createGroup(ctx context.Context, groupName string) (string, error) {
+	config := t.session.Config
+	template := config.IdcsCreateGroupPayload
+	if len(template) < 1 {
+		template = defaultCreateGroupPayload
+	}
+	description := config.IdcsGroupDescription
+	if len(description) < 1 {
+		description = defaultGroupDescription
+	}
+	description = strings.ReplaceAll(description, "%GROUPNAME%", groupName)
+	payload := strings.ReplaceAll(template, "%DESCRIPTION%", jsonEscape(description))
+	payload = strings.ReplaceAll(payload, "%GROUPNAME%", jsonEscape(groupName))
+
+	if t.session.Plan != nil {
+		t.session.Plan.add(ctx, AriaServicePerson{}, t.Name(), PlanGroupCreate, groupName)
+		return plannedGroupID + groupName, nil
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", config.IdcsBaseURL+"/admin/v1/Groups", strings.NewReader(payload))
+	if err := t.authorize(req); err != nil {
+		return "", err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Length", strconv.Itoa(len(payload)))
+	res, err := t.http.Do(req)
+	if err != nil || res == nil || res.StatusCode != 201 {
+		return "", httpError("Creating IDCS group ["+groupName+"]", err, res)
+	}
+	defer res.Body.Close()
+
+	json, _ := ioutil.ReadAll(res.Body)
+	groupID := gjson.Get(string(json), "id").String()
+	logFrom(ctx).Infof("*** Created IDCS group [%s] with ID [%s]", groupName, groupID)
+	return groupID, nil
+}
+
+//
+// Get a managed group's IDCS ID from the IDs resolved at startup
+//
+func (t *idcsTarget) groupID(groupName string) (string, error) {
+	groupID, ok := t.groupIDs[groupName]
+	if !ok {
+		return "", fmt.Errorf("ERROR: Getting Group ID from IDCS: Group Name [%s] was not resolved at startup", groupName)
+	}
+	return groupID, nil
+}
+
+//
+// Get a group's IDCS ID based on group name, returning an empty ID if there is no such group
+//
+func (t *idcsTarget) lookupGroupID(ctx context.Context, groupName string) (string, error) {
+	queryString := url.QueryEscape("displayName eq \"" + strings.TrimSpace(groupName) + "\"")
+	result, err := singleSCIMResource(ctx, t.http, t.session.Config.IdcsBaseURL+"/admin/v1/Groups?filter="+queryString,
+		t.authorize, "Getting Group ID from IDCS")
+	if err != nil || result == nil {
+		return "", err
+	}
+	return result.Get("id").String(), nil
+}
+
+//
+// Returns the set of IDCS group IDs that a user is currently a member of, using the groups read along with the
+// user when they are there and asking IDCS otherwise
+//
+func (t *idcsTarget) currentGroupIDs(ctx context.Context, existing *RemoteIdentity) (map[string]bool, error) {
+	if !existing.Data.Get("groups").Exists() {
+		return t.userGroupIDs(ctx, existing.ID)
+	}
+	groups := make(map[string]bool)
+	for _, id := range existing.Data.Get("groups.#.value").Array() {
+		groups[id.String()] = true
+	}
+	return groups, nil
+}
+
+//
+// Returns the set of IDCS group IDs that a user is currently a member of
+//
+func (t *idcsTarget) userGroupIDs(ctx context.Context, UserID string) (map[string]bool, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", t.session.Config.IdcsBaseURL+"/admin/v1/Users/"+UserID+"?attributes=groups", nil)
+	if err := t.authorize(req); err != nil {
+		return nil, err
+	}
+	res, err := t.http.Do(req)
+	if err != nil || res == nil || res.StatusCode != 200 {
+		return nil, httpError("Getting user groups from IDCS", err, res)
+	}
+	defer res.Body.Close()
+
+	json, _ := ioutil.ReadAll(res.Body)
+	groups := make(map[string]bool)
+	for _, id := range gjson.Get(string(json), "groups.#.value").Array() {
+		groups[id.String()] = true
+	}
+	return groups, nil
+}
+
+//
+// Fill in an IDCS payload template with the person's data
+//
+func renderIDCSPayload(template string, person AriaServicePerson) string {
+	payload := strings.ReplaceAll(template, "%USERNAME%", person.UserID)
+	payload = strings.ReplaceAll(payload, "%FIRSTNAME%", person.FirstName)
+	payload = strings.ReplaceAll(payload, "%LASTNAME%", person.LastName)
+	payload = strings.ReplaceAll(payload, "%MANAGER%", person.Manager)
+	payload = strings.ReplaceAll(payload, "%MANAGERCHAIN%", person.MgrChain)
+	payload = strings.ReplaceAll(payload, "%LOB%", person.Lob)
+	payload = strings.ReplaceAll(payload, "%LOBPARENT%", person.LobParent)
+	return payload
+}
+
+//
+// Escape a value for substitution between the quotes of a JSON string in a payload template
+//
+func jsonEscape(value string) string {
+	data, _ := json.Marshal(value)
+	return string(data[1 : len(data)-1])
+}
+
+//
+// Read a SCIM attribute path from a user record.  Extension attributes are addressed by their full schema URN
+// (e.g. urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department), whose dots must be escaped before
+// the path can be used with gjson.
+//
+func scimAttribute(data gjson.Result, path string) gjson.Result {
+	if !strings.HasPrefix(path, "urn:") {
+		return data.Get(path)
+	}
+	i := strings.LastIndex(path, ":")
+	return data.Get(strings.ReplaceAll(path[:i], ".", "\\.")).Get(path[i+1:])
+}
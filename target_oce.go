@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// oceTarget shares the OCE artifacts folder with users as downloaders.  OCE users themselves are created by
+// synchronizing profile data from IDCS so this target must run after IDCS has been processed.
+type oceTarget struct {
+	session *Session
+	http    *HTTPClient
+}
+
+//
+// OCE is enabled whenever an OCE base URL is configured
+//
+func newOCETargets(session *Session) ([]Target, error) {
+	if len(session.Config.OceBaseURL) < 1 {
+		return nil, nil
+	}
+	return []Target{&oceTarget{session: session, http: NewHTTPClient(session.Config, session.Client, "OCE")}}, nil
+}
+
+func (t *oceTarget) Name() string {
+	return "OCE"
+}
+
+//
+// OCE is only for ECAL application mappings
+//
+func (t *oceTarget) Applies(person AriaServicePerson) bool {
+	return strings.Contains(person.AppMap, "ECAL")
+}
+
+//
+// Synchronize OEC user/profile data with IDCS.  This is a costly operation so should only be executed once
+// after all user changes have been made in IDCS but before any activity can be initiated for user mapping in
+// OCE.  In plan mode the sync is held back.
+//
+func (t *oceTarget) Prepare(ctx context.Context) error {
+	config := t.session.Config
+	if t.session.Plan != nil {
+		t.session.Plan.add(ctx, AriaServicePerson{}, t.Name(), PlanSync, "Synchronize IDCS user/profile data to OCE")
+		return nil
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", config.OceBaseURL+"/documents/integration/ecal?IdcService=SYNC_USERS_AND_ATTRIBUTES", nil)
+	if err := t.authorize(req); err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	res, err := t.http.DoIdempotent(req)
+	if err != nil || res == nil || res.StatusCode != 200 {
+		return httpError("Sync Profile Data", err, res)
+	}
+	defer res.Body.Close()
+	return nil // we so happy
+}
+
+//
+// Get the OCE user id by their email
+//
+func (t *oceTarget) Lookup(ctx context.Context, person AriaServicePerson) (*RemoteIdentity, error) {
+	config := t.session.Config
+	queryString := "email=" + person.UserID
+	req, _ := http.NewRequestWithContext(ctx, "GET", config.OceBaseURL+"/documents/api/1.2/users/search/items?"+queryString, nil)
+	if err := t.authorize(req); err != nil {
+		return nil, err
+	}
+	res, err := t.http.Do(req)
+	if err != nil || res == nil || res.StatusCode != 200 {
+		return nil, httpError("OCE -> Get user by email", err, res)
+	}
+	defer res.Body.Close()
+
+	json, _ := ioutil.ReadAll(res.Body)
+	result := gjson.Get(string(json), "items.0")
+	if len(result.Get("id").String()) < 1 {
+		return nil, nil
+	}
+	return &RemoteIdentity{ID: result.Get("id").String(), Email: person.UserID, Data: result}, nil
+}
+
+//
+// OCE users can't be created directly, they only appear once IDCS profile data has been synced.  In plan mode
+// this is expected for users that the same run would create in IDCS.
+//
+func (t *oceTarget) Create(ctx context.Context, person AriaServicePerson) (*RemoteIdentity, error) {
+	if t.session.Plan != nil {
+		t.session.Plan.add(ctx, person, t.Name(), PlanShare, "downloader on folder "+t.session.Config.OceArtifactsFolderID+" after profile sync")
+		return &RemoteIdentity{Email: person.UserID}, nil
+	}
+	return nil, fmt.Errorf("ERROR: Add User to OCE -> Get OCE id from email [%s]: No ID returned; OCE not synced with this user", person.UserID)
+}
+
+//
+// Add person as downloader for the Artifacts folder.  If the user has already been added to the folder then
+// squelch the error and continue on.  Returns whether the folder was shared with the person by this call.
+//
+func (t *oceTarget) Update(ctx context.Context, person AriaServicePerson, existing *RemoteIdentity) (bool, error) {
+	config := t.session.Config
+	if t.session.Plan != nil {
+		t.session.Plan.add(ctx, person, t.Name(), PlanShare, "downloader on folder "+config.OceArtifactsFolderID)
+		return true, nil
+	}
+
+	payload := strings.ReplaceAll(config.OceAddUserPayload, "%USERNAME%", existing.ID)
+	req, _ := http.NewRequestWithContext(ctx, "POST", config.OceBaseURL+"/documents/api/1.2/shares/"+config.OceArtifactsFolderID, strings.NewReader(payload))
+	if err := t.authorize(req); err != nil {
+		return false, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Length", strconv.Itoa(len(payload)))
+	res, err := t.http.DoIdempotent(req)
+	if err != nil || res == nil {
+		return false, httpError("Add User to OCE -> Add user as downloader to artifacts folder", err, res)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		returnBody, _ := ioutil.ReadAll(res.Body)
+		errorKey := gjson.Get(string(returnBody), "errorKey")
+		if !strings.HasPrefix(errorKey.String(), "!csFolderAlreadyShared") {
+			return false, &HTTPError{Status: res.StatusCode, Message: fmt.Sprintf(
+				"ERROR: Add User to OCE -> Add user as downloader to artifacts folder: %s: detail ->%s", res.Status, string(returnBody))}
+		}
+		return false, nil
+	}
+	return true, nil // me so happy
+}
+
+//
+// The OCE inventory is the artifacts folder members so anyone found in it is already shared
+//
+func (t *oceTarget) NeedsUpdate(person AriaServicePerson, existing *RemoteIdentity) bool {
+	return false
+}
+
+//
+// A person is granted downloader access to the artifacts folder
+//
+func (t *oceTarget) Entitlements(person AriaServicePerson) []string {
+	return []string{"downloader on folder " + t.session.Config.OceArtifactsFolderID}
+}
+
+//
+// Remove user as downloader from OCE folder.  If the user has already been removed from the folder then
+// squelch the error and continue on.
+//
+func (t *oceTarget) Delete(ctx context.Context, person AriaServicePerson, existing *RemoteIdentity) error {
+	config := t.session.Config
+	payload := strings.ReplaceAll(config.OceAddUserPayload, "%USERNAME%", existing.ID)
+	req, _ := http.NewRequestWithContext(ctx, "DELETE", config.OceBaseURL+"/documents/api/1.2/shares/"+config.OceArtifactsFolderID+"/user", strings.NewReader(payload))
+	if err := t.authorize(req); err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Length", strconv.Itoa(len(payload)))
+	res, err := t.http.Do(req)
+	if err != nil || res == nil {
+		return httpError("Delete user from OCE -> Remove user as downloader to artifacts folder", err, res)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		returnBody, _ := ioutil.ReadAll(res.Body)
+		errorKey := gjson.Get(string(returnBody), "errorKey")
+		if !strings.HasPrefix(errorKey.String(), "!csUserHasNotBeenShared") {
+			return &HTTPError{Status: res.StatusCode, Message: fmt.Sprintf(
+				"ERROR: Remove user from OCE -> Remove user as downloader to artifacts folder: %s: detail ->%s", res.Status,
+				string(returnBody))}
+		}
+
+		logFrom(ctx).Infof("User [%s] already unshared from OEC folder", person.DisplayName)
+	}
+	return nil // me so happy
+}
+
+//
+// The OCE users this tool manages are the members of the artifacts folder, read a page at a time
+//
+func (t *oceTarget) List(ctx context.Context) ([]RemoteIdentity, error) {
+	config := t.session.Config
+	var identities []RemoteIdentity
+	err := eachOCEItem(ctx, t.http, config.OceBaseURL+"/documents/api/1.2/shares/"+config.OceArtifactsFolderID+"/items",
+		t.authorize, "Get OCE artifacts folder members", func(item gjson.Result) error {
+			if item.Get("type").String() == "user" {
+				identities = append(identities, RemoteIdentity{ID: item.Get("id").String(), Email: item.Get("email").String(), Data: item})
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+//
+// OCE calls use the service account's basic credentials when they are configured, otherwise an IDCS bearer
+// token with the OCE scope
+//
+func (t *oceTarget) authorize(req *http.Request) error {
+	config := t.session.Config
+	if len(config.OceUsername) > 0 {
+		req.SetBasicAuth(config.OceUsername, config.OcePassword)
+		return nil
+	}
+
+	accessToken, err := t.session.OCEToken.Token(req.Context())
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// vbcsAppTarget provisions users into the user business object of a single VBCS app
+type vbcsAppTarget struct {
+	session *Session
+	app     VbcsApp
+	http    *HTTPClient
+	batch   *vbcsBatchWriter // nil unless the app's BatchSize is set
+}
+
+//
+// Builds a target for each VBCS app listed in the VbcsApps config array.  Trailing slashes are dropped from
+// UserEndpoint so batch requests go to the path above the business object.  Returns an error for an app whose
+// UserEndpoint isn't an absolute URL with a path and for an app that can deactivate leavers but not reactivate them
+// when they come back.
+//
+func newVBCSTargets(session *Session) ([]Target, error) {
+	var targets []Target
+	for _, app := range session.Config.VbcsApps {
+		app.UserEndpoint = strings.TrimRight(app.UserEndpoint, "/")
+		endpoint, err := url.Parse(app.UserEndpoint)
+		if err != nil || len(endpoint.Scheme) < 1 || len(endpoint.Host) < 1 || len(strings.Trim(endpoint.Path, "/")) < 1 {
+			return nil, fmt.Errorf("ERROR: UserEndpoint [%s] of VBCS app [%s] isn't a URL with a path", app.UserEndpoint, app.Name)
+		}
+		if (len(app.UserDeactivatePayload) > 0) != (len(app.UserReactivatePayload) > 0) {
+			return nil, fmt.Errorf("ERROR: VBCS app [%s] must set both UserDeactivatePayload and UserReactivatePayload or neither",
+				app.Name)
+		}
+		target := &vbcsAppTarget{session: session, app: app, http: NewHTTPClient(session.Config, session.Client, app.Name)}
+		if app.BatchSize > 0 {
+			target.batch = newVBCSBatchWriter(app, target.http, target.authorize)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+func (t *vbcsAppTarget) Name() string {
+	return t.app.Name
+}
+
+//
+// Batches hold up to the app's BatchSize writes when batching is enabled
+//
+func (t *vbcsAppTarget) BatchSize() int {
+	if t.batch == nil {
+		return 0
+	}
+	return t.app.BatchSize
+}
+
+//
+// A person is only provisioned into the apps listed in their app mapping
+//
+func (t *vbcsAppTarget) Applies(person AriaServicePerson) bool {
+	return strings.Contains(person.AppMap, t.app.AppMapKey)
+}
+
+//
+// Search for the user by their email which is a unique attribute in VBCS
+//
+func (t *vbcsAppTarget) Lookup(ctx context.Context, person AriaServicePerson) (*RemoteIdentity, error) {
+	queryString := "q=" + url.QueryEscape("userEmail='"+person.UserID+"'")
+	result, err := singleVBCSItem(ctx, t.http, t.app.UserEndpoint+"?"+queryString, t.authorize, "Get "+t.app.Name+" user by email")
+	if err != nil || result == nil {
+		return nil, err
+	}
+	return &RemoteIdentity{ID: result.Get("id").String(), Email: result.Get("userEmail").String(), Data: *result}, nil
+}
+
+//
+// Add a user who does not exist in the VBCS app
+//
+func (t *vbcsAppTarget) Create(ctx context.Context, person AriaServicePerson) (*RemoteIdentity, error) {
+	payload := t.renderPayload(t.app.UserAddPayload, person)
+	if t.session.Plan != nil {
+		t.session.Plan.add(ctx, person, t.app.Name, PlanCreate, payload)
+		return &RemoteIdentity{Email: person.UserID}, nil
+	}
+	if t.batch != nil {
+		result, err := t.batch.Submit(ctx, "create", "", payload)
+		if err != errBatchRejected {
+			if err != nil {
+				return nil, err
+			}
+			if result.status != 201 && result.status != 200 {
+				return nil, result.failure("Adding user to " + t.app.Name + " -> Add New User")
+			}
+			return &RemoteIdentity{ID: result.response.Get("id").String(), Email: person.UserID, Data: result.response}, nil
+		}
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", t.app.UserEndpoint, strings.NewReader(payload))
+	req.SetBasicAuth(t.session.Config.VbcsUsername, t.session.Config.VbcsPassword)
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Length", strconv.Itoa(len(payload)))
+	res, err := t.http.Do(req)
+	if err != nil || res == nil || (res.StatusCode != 201 && res.StatusCode != 200) {
+		return nil, httpError("Adding user to "+t.app.Name+" -> Add New User", err, res)
+	}
+	defer res.Body.Close()
+
+	json, _ := ioutil.ReadAll(res.Body)
+	result := gjson.Parse(string(json))
+	return &RemoteIdentity{ID: result.Get("id").String(), Email: person.UserID, Data: result}, nil
+}
+
+//
+// In case a manager, name, or role changed the rendered update payload is compared with the existing record and
+// the user is only PATCHed when at least one field differs.  Each changed field is logged.  A leaver who was
+// deactivated and has come back to the feed is reactivated first.  Returns whether anything was written.
+//
+func (t *vbcsAppTarget) Update(ctx context.Context, person AriaServicePerson, existing *RemoteIdentity) (bool, error) {
+	reactivated := false
+	if t.isDeactivated(existing) {
+		logFrom(ctx).Infof("** User is back in the corporate identity feed, reactivating in %s", t.app.Name)
+		if err := t.patch(ctx, person, existing, t.renderPayload(t.app.UserReactivatePayload, person), "reactivate"); err != nil {
+			return false, err
+		}
+		reactivated = true
+	}
+
+	payload := t.renderPayload(t.app.UserUpdatePayload, person)
+	changes := changedFields(payload, existing)
+	if len(changes) < 1 {
+		logFrom(ctx).Infof("** User is up to date in %s", t.app.Name)
+		return reactivated, nil
+	}
+	for _, change := range changes {
+		logFrom(ctx).Infof("** %s %s", t.app.Name, change)
+	}
+	return true, t.patch(ctx, person, existing, payload, strings.Join(changes, "; "))
+}
+
+//
+// An inventoried user needs an update when they were deactivated or when any field of the rendered update payload
+// differs from their record
+//
+func (t *vbcsAppTarget) NeedsUpdate(person AriaServicePerson, existing *RemoteIdentity) bool {
+	return t.isDeactivated(existing) || len(changedFields(t.renderPayload(t.app.UserUpdatePayload, person), existing)) > 0
+}
+
+//
+// A person is granted the app's manager or user role
+//
+func (t *vbcsAppTarget) Entitlements(person AriaServicePerson) []string {
+	return []string{"role " + t.renderPayload("%ROLE%", person)}
+}
+
+//
+// Mark a leaver inactive with the app's UserDeactivatePayload.  Apps without one keep the record untouched until
+// the leaver is deleted.
+//
+func (t *vbcsAppTarget) Deactivate(ctx context.Context, person AriaServicePerson, existing *RemoteIdentity) error {
+	if len(t.app.UserDeactivatePayload) < 1 {
+		logFrom(ctx).Infof("** No UserDeactivatePayload for %s, user is kept until they are deleted", t.app.Name)
+		return nil
+	}
+	return t.patch(ctx, person, existing, t.renderPayload(t.app.UserDeactivatePayload, person), "deactivate")
+}
+
+//
+// A record is deactivated when every field of the app's UserDeactivatePayload already has the deactivated value
+//
+func (t *vbcsAppTarget) isDeactivated(existing *RemoteIdentity) bool {
+	if len(t.app.UserDeactivatePayload) < 1 {
+		return false
+	}
+	return len(changedFields(t.renderPayload(t.app.UserDeactivatePayload, AriaServicePerson{}), existing)) < 1
+}
+
+//
+// PATCH an existing user with a rendered payload, in a batch when batching is enabled.  In plan mode the PATCH is
+// recorded in the plan with the given detail instead.
+//
+func (t *vbcsAppTarget) patch(ctx context.Context, person AriaServicePerson, existing *RemoteIdentity, payload string, detail string) error {
+	if t.session.Plan != nil {
+		t.session.Plan.add(ctx, person, t.app.Name, PlanUpdate, detail)
+		return nil
+	}
+	if t.batch != nil {
+		result, err := t.batch.Submit(ctx, "update", existing.ID, payload)
+		if err != errBatchRejected {
+			if err != nil {
+				return err
+			}
+			if result.status != 200 && result.status != 409 {
+				return result.failure("Add User to " + t.app.Name + " -> Update User")
+			}
+			return nil
+		}
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "PATCH", t.app.UserEndpoint+"/"+existing.ID, strings.NewReader(payload))
+	req.SetBasicAuth(t.session.Config.VbcsUsername, t.session.Config.VbcsPassword)
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Length", strconv.Itoa(len(payload)))
+	res, err := t.http.DoIdempotent(req)
+	if err != nil || res == nil || (res.StatusCode != 200 && res.StatusCode != 409) {
+		return httpError("Add User to "+t.app.Name+" -> Update User", err, res)
+	}
+	defer res.Body.Close()
+	return nil
+}
+
+//
+// Delete user from VBCS app.  Batched writes that VBCS rejected as part of a whole batch are resent on their own.
+//
+func (t *vbcsAppTarget) Delete(ctx context.Context, person AriaServicePerson, existing *RemoteIdentity) error {
+	if t.batch != nil {
+		result, err := t.batch.Submit(ctx, "delete", existing.ID, "")
+		if err != errBatchRejected {
+			if err != nil {
+				return err
+			}
+			if result.status != 200 && result.status != 204 {
+				return result.failure("Delete " + t.app.Name + " user")
+			}
+			return nil
+		}
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "DELETE", t.app.UserEndpoint+"/"+existing.ID, nil)
+	req.SetBasicAuth(t.session.Config.VbcsUsername, t.session.Config.VbcsPassword)
+	res, err := t.http.Do(req)
+	if err != nil || res == nil || (res.StatusCode != 200 && res.StatusCode != 204) {
+		return httpError("Delete "+t.app.Name+" user", err, res)
+	}
+	defer res.Body.Close()
+	return nil
+}
+
+//
+// Get all users from the VBCS app, a page at a time.  Whole records are read so they can be diffed against the
+// update payload.
+//
+func (t *vbcsAppTarget) List(ctx context.Context) ([]RemoteIdentity, error) {
+	var identities []RemoteIdentity
+	err := eachVBCSItem(ctx, t.http, t.app.UserEndpoint+"?onlyData=true", t.authorize,
+		"Get all users from "+t.app.Name+" app", func(item gjson.Result) error {
+			identities = append(identities, RemoteIdentity{ID: item.Get("id").String(), Email: item.Get("userEmail").String(), Data: item})
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+//
+// Fill in a VBCS payload template with the person's data.  Managers and individual contributors get different
+// role codes.
+//
+func (t *vbcsAppTarget) renderPayload(template string, person AriaServicePerson) string {
+	payload := strings.ReplaceAll(template, "%USERNAME%", person.UserID)
+	payload = strings.ReplaceAll(payload, "%FIRSTNAME%", person.FirstName)
+	payload = strings.ReplaceAll(payload, "%LASTNAME%", person.LastName)
+	payload = strings.ReplaceAll(payload, "%MANAGER%", person.Manager)
+	payload = strings.ReplaceAll(payload, "%MANAGERCHAIN%", person.MgrChain)
+	payload = strings.ReplaceAll(payload, "%LOB%", person.Lob)
+	payload = strings.ReplaceAll(payload, "%LOBPARENT%", person.LobParent)
+	if person.NumberOfDirects > 0 {
+		payload = strings.ReplaceAll(payload, "%ROLE%", t.app.ManagerRoleCode)
+	} else {
+		payload = strings.ReplaceAll(payload, "%ROLE%", t.app.UserRoleCode)
+	}
+	return payload
+}
+
+//
+// VBCS calls use the service account's basic credentials
+//
+func (t *vbcsAppTarget) authorize(req *http.Request) error {
+	req.SetBasicAuth(t.session.Config.VbcsUsername, t.session.Config.VbcsPassword)
+	return nil
+}
+
+//
+// Compares every field of a rendered payload with the existing record and describes each field whose value
+// differs as "field: old -> new"
+//
+func changedFields(payload string, existing *RemoteIdentity) []string {
+	var changes []string
+	gjson.Parse(payload).ForEach(func(field, value gjson.Result) bool {
+		current := existing.Data.Get(field.String())
+		if !current.Exists() || !sameValue(current, value) {
+			changes = append(changes, field.String()+": "+current.Raw+" -> "+value.Raw)
+		}
+		return true
+	})
+	return changes
+}
+
+//
+// Reports whether two JSON values are equal.  Scalars are compared by their string form so a role code sent as a
+// string matches the number VBCS returns, and objects and arrays are compared by their compacted JSON.
+//
+func sameValue(current gjson.Result, desired gjson.Result) bool {
+	if current.IsObject() || current.IsArray() || desired.IsObject() || desired.IsArray() {
+		var currentJSON, desiredJSON bytes.Buffer
+		if json.Compact(&currentJSON, []byte(current.Raw)) != nil || json.Compact(&desiredJSON, []byte(desired.Raw)) != nil {
+			return false
+		}
+		return currentJSON.String() == desiredJSON.String()
+	}
+	return current.String() == desired.String()
+}
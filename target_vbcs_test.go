@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestNewVBCSTargetsEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		wantRoot string // empty when the endpoint is rejected
+	}{
+		{"plain", "https://vbcs.example.com/ic/builder/rt/ECAL/live/resources/data/User", "https://vbcs.example.com/ic/builder/rt/ECAL/live/resources/data"},
+		{"trailing slash", "https://vbcs.example.com/ic/builder/rt/ECAL/live/resources/data/User/", "https://vbcs.example.com/ic/builder/rt/ECAL/live/resources/data"},
+		{"trailing slashes", "https://vbcs.example.com/data/User//", "https://vbcs.example.com/data"},
+		{"no path", "https://vbcs.example.com", ""},
+		{"root path", "https://vbcs.example.com/", ""},
+		{"relative", "resources/data/User", ""},
+	}
+	for _, test := range tests {
+		session := &Session{Client: http.DefaultClient, Config: Config{VbcsApps: []VbcsApp{
+			{Name: "ECAL", UserEndpoint: test.endpoint, BatchSize: 10},
+		}}}
+		targets, err := newVBCSTargets(session)
+		if len(test.wantRoot) < 1 {
+			if err == nil {
+				t.Errorf("%s: newVBCSTargets(%q) accepted the endpoint", test.name, test.endpoint)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: newVBCSTargets(%q) returned %v", test.name, test.endpoint, err)
+			continue
+		}
+		batch := targets[0].(*vbcsAppTarget).batch
+		if batch.rootURL != test.wantRoot {
+			t.Errorf("%s: batches of %q go to %q, want %q", test.name, test.endpoint, batch.rootURL, test.wantRoot)
+		}
+		if path := batch.app.UserEndpoint[len(batch.rootURL):]; path != "/User" {
+			t.Errorf("%s: batch parts of %q use path %q, want /User", test.name, test.endpoint, path)
+		}
+	}
+}
+
+func TestChangedFields(t *testing.T) {
+	existing := &RemoteIdentity{Data: gjson.Parse(`{"email": "a@example.com", "roleCode": 2, "active": true,
+		"lobs": ["CTO", "OCI"], "manager": {"email": "m@example.com", "level": 3}}`)}
+	tests := []struct {
+		name    string
+		payload string
+		want    []string
+	}{
+		{"unchanged", `{"email": "a@example.com", "active": true}`, nil},
+		{"role code as a string", `{"roleCode": "2"}`, nil},
+		{"nested values compacted", `{"lobs": [ "CTO","OCI" ], "manager": {"email":"m@example.com",  "level":3}}`, nil},
+		{"changed scalar", `{"roleCode": "3"}`, []string{`roleCode: 2 -> "3"`}},
+		{"changed nested value", `{"lobs": ["CTO"]}`, []string{`lobs: ["CTO", "OCI"] -> ["CTO"]`}},
+		{"missing field", `{"lob": "CTO"}`, []string{`lob:  -> "CTO"`}},
+		{"empty string is not missing", `{"email": ""}`, []string{`email: "a@example.com" -> ""`}},
+	}
+	for _, test := range tests {
+		if got := changedFields(test.payload, existing); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: changedFields(%s) = %q, want %q", test.name, test.payload, got, test.want)
+		}
+	}
+}
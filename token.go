@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// IDCSScope is the OAuth scope used for IDCS admin API calls
+const IDCSScope = "urn:opc:idm:__myscopes__"
+
+// OCEScope is the OAuth scope used for OCE API calls
+const OCEScope = "urn:opc:cec:all"
+
+// tokenRefreshMargin is how long before expiry a token is replaced
+const tokenRefreshMargin = 5 * time.Minute
+
+// defaultTokenLifetime is assumed when the token endpoint doesn't return expires_in
+const defaultTokenLifetime = 3600 * time.Second
+
+// TokenSource hands out an IDCS OAuth2 client credentials token for a single scope.  The token is cached and
+// refreshed shortly before it expires.  A TokenSource is safe to use from many goroutines.
+type TokenSource struct {
+	config Config
+	client *HTTPClient
+	scope  string
+
+	mutex       sync.Mutex
+	accessToken string
+	expiry      time.Time
+}
+
+//
+// Returns a token source for the given scope.  No token is requested until the first call to Token.
+//
+func NewTokenSource(config Config, client *HTTPClient, scope string) *TokenSource {
+	return &TokenSource{config: config, client: client, scope: scope}
+}
+
+//
+// Returns a valid access token, requesting a new one if there is no token yet or the current one is about to
+// expire.  Concurrent callers wait for a single refresh rather than each requesting their own token.  Transient
+// token endpoint failures are retried according to the client's retry policy.
+//
+func (source *TokenSource) Token(ctx context.Context) (string, error) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	if len(source.accessToken) > 0 && time.Now().Before(source.expiry) {
+		return source.accessToken, nil
+	}
+
+	accessToken, lifetime, err := source.requestToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// refresh ahead of expiry, or halfway through the lifetime for unusually short-lived tokens
+	margin := tokenRefreshMargin
+	if lifetime <= 2*margin {
+		margin = lifetime / 2
+	}
+	source.accessToken = accessToken
+	source.expiry = time.Now().Add(lifetime - margin)
+	return accessToken, nil
+}
+
+//
+// Authenticate to IDCS and retrieve an OAuth2 bearer token along with its lifetime.  Token requests can safely be
+// repeated so transient failures are retried by the HTTP client.
+//
+func (source *TokenSource) requestToken(ctx context.Context) (string, time.Duration, error) {
+	data := url.Values{}
+	data.Set("grant_type", "client_credentials")
+	data.Set("scope", source.scope)
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", source.config.IdcsBaseURL+"/oauth2/v1/token", strings.NewReader(data.Encode()))
+	req.SetBasicAuth(source.config.IdcsClientID, source.config.IdcsClientSecret)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Content-Length", strconv.Itoa(len(data.Encode())))
+
+	res, err := source.client.DoIdempotent(req)
+	if err != nil || res == nil || res.StatusCode != 200 {
+		return "", 0, httpError("Getting IDCS bearer token for scope ["+source.scope+"]", err, res)
+	}
+	defer res.Body.Close()
+
+	json, _ := ioutil.ReadAll(res.Body)
+	accessToken := gjson.Get(string(json), "access_token").String()
+	if len(accessToken) < 1 {
+		return "", 0, errors.New("IDCS bearer token not retrieved")
+	}
+	redactor.add(accessToken)
+
+	lifetime := time.Duration(gjson.Get(string(json), "expires_in").Int()) * time.Second
+	if lifetime <= 0 {
+		lifetime = defaultTokenLifetime
+	}
+	return accessToken, lifetime, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// vbcsBatchContentType is the media type of a VBCS business object batch request
+const vbcsBatchContentType = "application/vnd.oracle.adf.batch+json"
+
+// errBatchRejected is returned for every part of a VBCS batch that was rejected as a whole.  VBCS rolls back the
+// entire batch when any part fails so each write has to be sent again on its own.
+var errBatchRejected = errors.New("VBCS batch rejected")
+
+// vbcsBatchWriter collects the creates, updates and deletes for a single VBCS app from every person in flight into
+// business object batch requests
+type vbcsBatchWriter struct {
+	app       VbcsApp
+	client    *HTTPClient
+	authorize func(req *http.Request) error
+	rootURL   string // business object resources root the batch request is sent to
+	queue     *batchQueue
+}
+
+//
+// Returns a batch writer for the app that sends batches of up to the app's BatchSize parts
+//
+func newVBCSBatchWriter(app VbcsApp, client *HTTPClient, authorize func(req *http.Request) error) *vbcsBatchWriter {
+	writer := &vbcsBatchWriter{app: app, client: client, authorize: authorize,
+		rootURL: app.UserEndpoint[:strings.LastIndex(app.UserEndpoint, "/")]}
+	writer.queue = newBatchQueue(app.BatchSize, writer.send)
+	return writer
+}
+
+//
+// Queue a create, update or delete of a user record and wait for its result.  id is empty for creates.  Returns
+// errBatchRejected when the batch the write was part of was rolled back.
+//
+func (writer *vbcsBatchWriter) Submit(ctx context.Context, operation string, id string, payload string) (bulkResult, error) {
+	path := writer.app.UserEndpoint[len(writer.rootURL):]
+	if len(id) > 0 {
+		path += "/" + id
+	}
+	result, err := writer.queue.submit(ctx, operation, path, payload)
+	if err != nil {
+		return result, err
+	}
+	logFrom(ctx).Infof("** %s batch %s %s -> %d (batch of %d)", writer.app.Name, operation, path, result.status, result.batchSize)
+	return result, nil
+}
+
+//
+// Send a batch as a single request and deliver each part's result to the person waiting on it
+//
+func (writer *vbcsBatchWriter) send(batch []*bulkOperation) {
+	type part struct {
+		ID        string          `json:"id"`
+		Path      string          `json:"path"`
+		Operation string          `json:"operation"`
+		Payload   json.RawMessage `json:"payload,omitempty"`
+	}
+	var request struct {
+		Parts []part `json:"parts"`
+	}
+	for _, op := range batch {
+		var payload json.RawMessage
+		if len(op.data) > 0 {
+			payload = json.RawMessage(op.data)
+		}
+		request.Parts = append(request.Parts, part{ID: op.bulkID, Path: op.path, Operation: op.method, Payload: payload})
+	}
+
+	results, err := writer.post(request)
+	for _, op := range batch {
+		result, ok := results[op.bulkID]
+		if err != nil {
+			result = bulkResult{err: err}
+		} else if !ok {
+			result = bulkResult{err: fmt.Errorf("ERROR: %s batch %s %s: no result returned for this part", writer.app.Name,
+				op.method, op.path)}
+		}
+		result.batchSize = len(batch)
+		op.deliver(result)
+	}
+}
+
+//
+// POST a batch request and return the result of each part keyed by part id.  A part without its own status
+// succeeded; VBCS reports a failed part with the HTTP status it would have returned on its own.
+//
+func (writer *vbcsBatchWriter) post(request interface{}) (map[string]bulkResult, error) {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, _ := http.NewRequest("POST", writer.rootURL, strings.NewReader(string(payload)))
+	if err := writer.authorize(req); err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", vbcsBatchContentType)
+	req.Header.Add("Content-Length", strconv.Itoa(len(payload)))
+	res, err := writer.client.Do(req)
+	if err != nil || res == nil {
+		return nil, httpError("Sending "+writer.app.Name+" batch request", err, res)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		rootLog.forTarget(writer.app.Name).Warnf("%s", outputHTTPError("Sending "+writer.app.Name+" batch request, resending each part on its own", nil, res))
+		return nil, errBatchRejected
+	}
+
+	body, _ := ioutil.ReadAll(res.Body)
+	results := make(map[string]bulkResult)
+	for _, part := range gjson.Get(string(body), "parts").Array() {
+		status := int(part.Get("status").Int())
+		if status == 0 {
+			status = 200
+		}
+		results[part.Get("id").String()] = bulkResult{status: status, response: part.Get("payload")}
+	}
+	return results, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// RunCounters tracks per-loop outcomes and is safe to update from many workers
+type RunCounters struct {
+	succeeded int64
+	failed    int64
+}
+
+func (counters *RunCounters) Succeeded() int {
+	return int(atomic.LoadInt64(&counters.succeeded))
+}
+
+func (counters *RunCounters) Failed() int {
+	return int(atomic.LoadInt64(&counters.failed))
+}
+
+// workerPool lets a loop keep more people in flight than it has workers.  A person holds a worker while doing work
+// of their own and gives it up while waiting on the result of a batched write, so other people can queue their
+// writes into the same batch.  A nil workerPool has no people in flight.  It is safe to use from many goroutines.
+type workerPool struct {
+	workers chan struct{} // one slot per worker, held by each person doing work of their own
+	mutex   sync.Mutex
+	running int           // people in flight, or about to be, that aren't waiting on a batched write
+	idle    chan struct{} // closed whenever running is zero
+}
+
+type workerPoolKey struct{}
+
+// closedChannel is returned by a nil workerPool as it has nobody running
+var closedChannel = func() chan struct{} {
+	channel := make(chan struct{})
+	close(channel)
+	return channel
+}()
+
+//
+// Returns a workerPool with the given number of workers and nobody running
+//
+func newWorkerPool(workers int) *workerPool {
+	return &workerPool{workers: make(chan struct{}, workers), idle: closedChannel}
+}
+
+//
+// Count a person in flight as running
+//
+func (pool *workerPool) enter() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.running == 0 {
+		pool.idle = make(chan struct{})
+	}
+	pool.running++
+}
+
+//
+// Stop counting a person in flight as running
+//
+func (pool *workerPool) leave() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.running--
+	if pool.running == 0 {
+		close(pool.idle)
+	}
+}
+
+//
+// Give up the person's worker and stop counting them as running while they wait on a batched write
+//
+func (pool *workerPool) park() {
+	if pool == nil {
+		return
+	}
+	<-pool.workers
+	pool.leave()
+}
+
+//
+// Count a parked person as running again as soon as the result of their batched write is known, before they get
+// a worker back
+//
+func (pool *workerPool) wake() {
+	if pool == nil {
+		return
+	}
+	pool.enter()
+}
+
+//
+// Wait for a worker for a person that has been woken
+//
+func (pool *workerPool) unpark() {
+	if pool == nil {
+		return
+	}
+	pool.workers <- struct{}{}
+}
+
+//
+// Returns a channel that is closed while nobody in flight is running, so nobody can join a batch being collected
+//
+func (pool *workerPool) waiting() <-chan struct{} {
+	if pool == nil {
+		return closedChannel
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return pool.idle
+}
+
+//
+// Returns a context that carries the given worker pool
+//
+func withWorkerPool(ctx context.Context, pool *workerPool) context.Context {
+	return context.WithValue(ctx, workerPoolKey{}, pool)
+}
+
+//
+// Returns the worker pool carried by the context, or nil if there isn't one
+//
+func workerPoolFrom(ctx context.Context) *workerPool {
+	pool, _ := ctx.Value(workerPoolKey{}).(*workerPool)
+	return pool
+}
+
+//
+// Process every person with the given number of concurrent workers, keeping up to inFlight people in flight so that
+// people waiting on batched writes don't hold a worker.  The work function's log lines for each person are tagged
+// with the person's user ID, buffered and flushed to stdout as a single block when that person is done.  Once stop
+// is closed no more people are started but those in flight are finished.  The returned counters hold the number of
+// people that succeeded and failed.
+//
+func runWorkers(ctx context.Context, stop <-chan struct{}, people []AriaServicePerson, workers int, inFlight int,
+	work func(ctx context.Context, person AriaServicePerson) error) *RunCounters {
+	if workers < 1 {
+		workers = 1
+	}
+	if inFlight < workers {
+		inFlight = workers
+	}
+
+	counters := &RunCounters{}
+	pool := newWorkerPool(workers)
+	ctx = withWorkerPool(ctx, pool)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < inFlight; w++ {
+		// a goroutine waiting for its next person counts as running until there are no more people so that a
+		// batch isn't sent while someone could still join it
+		pool.enter()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer pool.leave()
+			for i := range jobs {
+				pool.workers <- struct{}{}
+				person := people[i]
+				var buffer bytes.Buffer
+				log := logFrom(ctx).forUser(person.UserID, &buffer)
+				log.Infof("* Processing user [%d/%d] -> %s", i+1, len(people), person.DisplayName)
+
+				if err := work(withLogger(ctx, log), person); err != nil {
+					log.Errorf("%s", err.Error())
+					atomic.AddInt64(&counters.failed, 1)
+				} else {
+					atomic.AddInt64(&counters.succeeded, 1)
+				}
+				log.flush(buffer.Bytes())
+				<-pool.workers
+			}
+		}()
+	}
+
+dispatch:
+	for i := range people {
+		select {
+		case <-stop:
+			break dispatch
+		default:
+		}
+		select {
+		case jobs <- i:
+		case <-stop:
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return counters
+}
+
+//
+// Returns a channel that is closed on the first SIGINT or SIGTERM so the users in flight can finish and the run can
+// save its progress.  A second signal stops the process straight away.
+//
+func notifyInterrupt() <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	stop := make(chan struct{})
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		rootLog.Warnf("*** Interrupted, finishing the users in flight before exiting...")
+		close(stop)
+	}()
+	return stop
+}
+
+//
+// Reports whether stop has been closed
+//
+func interrupted(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}